@@ -4,13 +4,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/improbable-eng/go-httpwares/logging/logrus/ctxlogrus"
 	"github.com/nullseed/logruseq"
@@ -18,6 +23,8 @@ import (
 	"github.com/scytrin/eridanus/fetcher"
 	"github.com/scytrin/eridanus/storage"
 	"github.com/scytrin/eridanus/storage/backend/diskv"
+	"github.com/scytrin/eridanus/storage/bundles"
+	"github.com/scytrin/eridanus/storage/importers"
 	"github.com/sirupsen/logrus"
 )
 
@@ -67,6 +74,100 @@ func main() {
 	})
 
 	s := storage.NewStorage(sbe)
+	switch flag.Arg(0) {
+	case "explain":
+		if err := explainURLs(s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "conflicts":
+		if err := listConflicts(s); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "find":
+		if err := find(s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "rebuild-tag-index":
+		if err := s.TagStorage().RebuildIndex(); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "migrate-tags":
+		n, err := s.TagStorage().MigrateTags()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("migrated %d items\n", n)
+		log.Exit(0)
+	case "delete-tag-service":
+		if flag.NArg() != 2 {
+			log.Fatal("usage: delete-tag-service NAME")
+		}
+		if err := s.TagStorage().DeleteService(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "domain-synonyms":
+		synonyms, err := s.ClassesStorage().DomainSynonyms()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var aliases []string
+		for alias := range synonyms {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		for _, alias := range aliases {
+			fmt.Printf("%s\t%s\n", alias, synonyms[alias])
+		}
+		log.Exit(0)
+	case "set-domain-synonym":
+		if flag.NArg() != 2 && flag.NArg() != 3 {
+			log.Fatal("usage: set-domain-synonym ALIAS [CANONICAL]")
+		}
+		if err := s.ClassesStorage().SetDomainSynonym(flag.Arg(1), flag.Arg(2)); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "versions", "diff", "rollback":
+		if err := versioned(s, flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "export-bundle":
+		if err := exportBundle(s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "import-bundle":
+		if err := importBundle(s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "seed-defaults":
+		if err := seedDefaults(s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "outdated-defaults":
+		outdated, err := bundles.OutdatedDefaults(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeOutdated(os.Stdout, outdated); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	case "import-hydrus":
+		if err := importHydrus(s, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		log.Exit(0)
+	}
+
 	f, err := fetcher.NewFetcher(s)
 	if err != nil {
 		log.Fatal(err)
@@ -79,7 +180,7 @@ func main() {
 
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", *appPort),
-		Handler: http.HandlerFunc(jsonCmdHandler),
+		Handler: newServer(s, f),
 	}
 	logrus.DeferExitHandler(func() {
 		if err := httpServer.Shutdown(ctx); err != nil {
@@ -92,23 +193,212 @@ func main() {
 	}
 }
 
-func jsonCmdHandler(w http.ResponseWriter, r *http.Request) {
-	log := logrus.StandardLogger()
-	defer r.Body.Close()
+// explainURLs prints how each URL is classified by the stored classes.
+func explainURLs(s eridanus.Storage, urls []string) error {
+	ucs, err := s.ClassesStorage().GetAll()
+	if err != nil {
+		return err
+	}
+	synonyms, err := s.ClassesStorage().DomainSynonyms()
+	if err != nil {
+		return err
+	}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		if err := writeExplanations(os.Stdout, u, eridanus.ExplainClassify(u, ucs, synonyms)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	var req interface{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// listConflicts prints the pairs of stored classes which match the same example URLs.
+func listConflicts(s eridanus.Storage) error {
+	ucs, err := s.ClassesStorage().GetAll()
+	if err != nil {
+		return err
+	}
+	synonyms, err := s.ClassesStorage().DomainSynonyms()
+	if err != nil {
+		return err
 	}
-	log.Info(req)
+	return writeConflicts(os.Stdout, eridanus.FindClassConflicts(ucs, synonyms))
+}
 
-	var res interface{}
-	res = &eridanus.Command{Cmd: "okay"} // do stuff
-	if err := json.NewEncoder(w).Encode(res); err != nil {
-		log.Error(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// exportBundle writes a bundle named by the first argument, of the classes
+// named by the rest, to stdout.
+func exportBundle(s eridanus.Storage, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: export-bundle NAME CLASS...")
+	}
+	b, err := bundles.ExportBundle(s, args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	return bundles.Write(os.Stdout, b)
+}
+
+// find lists the hashes of items matching the query made of the arguments.
+func find(s eridanus.Storage, args []string) error {
+	fs := flag.NewFlagSet("find", flag.ContinueOnError)
+	service := fs.String("service", "", "search only the tags of the named service")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	q, err := eridanus.ParseTagQuery(strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+	ts := s.TagStorage()
+	if *service != "" {
+		if ts, err = ts.Service(*service); err != nil {
+			return err
+		}
+	}
+	hashes, err := ts.Find(q)
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		fmt.Println(h)
+	}
+	return nil
+}
+
+// versioned lists the versions of a class or parser, shows the differences
+// between two versions, or rolls back to a version, as cmd specifies.
+func versioned(s eridanus.Storage, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	author := fs.String("author", "", "record the rolled back version as by author")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	want := map[string]int{"versions": 2, "diff": 4, "rollback": 3}[cmd]
+	if fs.NArg() != want {
+		return fmt.Errorf("usage: %s class|parser NAME%s", cmd, map[string]string{"diff": " A B", "rollback": " VERSION"}[cmd])
+	}
+	var vs versionedStorage
+	switch fs.Arg(0) {
+	case "class":
+		vs = s.ClassesStorage()
+	case "parser":
+		vs = s.ParsersStorage()
+	default:
+		return fmt.Errorf("%s: unknown kind %q, want class or parser", cmd, fs.Arg(0))
+	}
+	name := fs.Arg(1)
+	v, err := parseVersions(fs.Args()[2:]...)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "versions":
+		revs, err := vs.Versions(name)
+		if err != nil {
+			return err
+		}
+		for _, r := range revs {
+			fmt.Printf("version %d by %q at %s\n%s", r.Version, r.Author, r.Time.Format(time.RFC3339), r.Diff)
+		}
+	case "diff":
+		diff, err := vs.Diff(name, v[0], v[1])
+		if err != nil {
+			return err
+		}
+		fmt.Print(diff)
+	case "rollback":
+		return vs.Rollback(name, v[0], *author)
+	}
+	return nil
+}
+
+// importBundle imports the bundle files named by the arguments.
+func importBundle(s eridanus.Storage, args []string) error {
+	fs := flag.NewFlagSet("import-bundle", flag.ContinueOnError)
+	conflict := fs.String("conflict", "skip", "skip, overwrite or rename definitions with names in use")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := bundles.ParseConflict(*conflict)
+	if err != nil {
+		return err
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		b, err := bundles.Read(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		report, err := bundles.ImportBundle(s, b, c)
+		if err != nil {
+			return err
+		}
+		if err := writeImportReport(os.Stdout, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedDefaults stores the built-in definitions.
+func seedDefaults(s eridanus.Storage, args []string) error {
+	fs := flag.NewFlagSet("seed-defaults", flag.ContinueOnError)
+	conflict := fs.String("conflict", "skip", "skip, overwrite or rename definitions with names in use")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := bundles.ParseConflict(*conflict)
+	if err != nil {
+		return err
+	}
+	report, err := bundles.SeedDefaults(s, c)
+	if err != nil {
+		return err
+	}
+	return writeImportReport(os.Stdout, report)
+}
+
+// importHydrus converts and imports the Hydrus downloader exports named by the
+// arguments, listing what could not be converted.
+func importHydrus(s eridanus.Storage, args []string) error {
+	fs := flag.NewFlagSet("import-hydrus", flag.ContinueOnError)
+	conflict := fs.String("conflict", "skip", "skip, overwrite or rename definitions with names in use")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := bundles.ParseConflict(*conflict)
+	if err != nil {
+		return err
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		b, conversion, err := importers.ConvertHydrus(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		b.Name = filepath.Base(path)
+		for _, u := range conversion.Unsupported {
+			fmt.Printf("unsupported\t%s\n", u)
+		}
+		report, err := bundles.ImportBundle(s, b, c)
+		if err != nil {
+			return err
+		}
+		if err := writeImportReport(os.Stdout, report); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/fetcher"
+	"github.com/scytrin/eridanus/storage/bundles"
+	"github.com/sirupsen/logrus"
+)
+
+// commandFunc handles a command, returning a json encodable response.
+type commandFunc func(cmd *eridanus.Command) (interface{}, error)
+
+// server answers json encoded commands, such as those relayed from the
+// browser extension by eridanus_nmh.
+type server struct {
+	s    eridanus.Storage
+	f    *fetcher.Fetcher
+	cmds map[string]commandFunc
+}
+
+func newServer(s eridanus.Storage, f *fetcher.Fetcher) *server {
+	srv := &server{s: s, f: f}
+	srv.cmds = map[string]commandFunc{
+		"ping":      srv.ping,
+		"explain":   srv.explain,
+		"conflicts": srv.conflicts,
+		"find":      srv.find,
+
+		"tag_counts":         srv.tagCounts,
+		"rebuild_tag_index":  srv.rebuildTagIndex,
+		"tags":               srv.tags,
+		"tag_records":        srv.tagRecords,
+		"tag_services":       srv.tagServices,
+		"delete_tag_service": srv.deleteTagService,
+		"migrate_tags":       srv.migrateTags,
+
+		"tag_siblings":         srv.tagSiblings,
+		"set_tag_sibling":      srv.setTagSibling,
+		"set_tag_sibling_mode": srv.setTagSiblingMode,
+		"tag_parents":          srv.tagParents,
+		"add_tag_parent":       srv.addTagParent,
+		"remove_tag_parent":    srv.removeTagParent,
+
+		"domain_synonyms":    srv.domainSynonyms,
+		"set_domain_synonym": srv.setDomainSynonym,
+
+		"delete_class":  srv.deleteClass,
+		"rename_class":  srv.renameClass,
+		"delete_parser": srv.deleteParser,
+		"rename_parser": srv.renameParser,
+
+		"class_versions":  srv.versions(s.ClassesStorage()),
+		"class_diff":      srv.diff(s.ClassesStorage()),
+		"rollback_class":  srv.rollback(s.ClassesStorage()),
+		"parser_versions": srv.versions(s.ParsersStorage()),
+		"parser_diff":     srv.diff(s.ParsersStorage()),
+		"rollback_parser": srv.rollback(s.ParsersStorage()),
+
+		"export_bundle": srv.exportBundle,
+		"import_bundle": srv.importBundle,
+
+		"seed_defaults":     srv.seedDefaults,
+		"outdated_defaults": srv.outdatedDefaults,
+	}
+	return srv
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logrus.StandardLogger()
+	defer r.Body.Close()
+
+	var cmd eridanus.Command
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Info(cmd.String())
+
+	h, ok := srv.cmds[cmd.GetCmd()]
+	if !ok {
+		// eridanus_nmh relays whatever the extension sends, expecting the
+		// okay reply for commands it has no handler for.
+		log.Warnf("unknown command %q", cmd.GetCmd())
+		h = srv.ping
+	}
+	res, err := h(&cmd)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (srv *server) ping(cmd *eridanus.Command) (interface{}, error) {
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// explain reports how each URL in the command's data is classified.
+func (srv *server) explain(cmd *eridanus.Command) (interface{}, error) {
+	ucs, err := srv.s.ClassesStorage().GetAll()
+	if err != nil {
+		return nil, err
+	}
+	synonyms, err := srv.s.ClassesStorage().DomainSynonyms()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]*eridanus.ClassifyExplanation)
+	for _, raw := range cmd.GetData() {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		out[raw] = eridanus.ExplainClassify(u, ucs, synonyms)
+	}
+	return out, nil
+}
+
+// conflicts reports the pairs of classes which match the same example URLs.
+func (srv *server) conflicts(cmd *eridanus.Command) (interface{}, error) {
+	ucs, err := srv.s.ClassesStorage().GetAll()
+	if err != nil {
+		return nil, err
+	}
+	synonyms, err := srv.s.ClassesStorage().DomainSynonyms()
+	if err != nil {
+		return nil, err
+	}
+	return eridanus.FindClassConflicts(ucs, synonyms), nil
+}
+
+// args returns the command's data, if it has exactly n items.
+func args(cmd *eridanus.Command, n int) ([]string, error) {
+	if len(cmd.GetData()) != n {
+		return nil, fmt.Errorf("%s: got %d arguments, want %d", cmd.GetCmd(), len(cmd.GetData()), n)
+	}
+	return cmd.GetData(), nil
+}
+
+// domainSynonyms returns the domain synonym table.
+func (srv *server) domainSynonyms(cmd *eridanus.Command) (interface{}, error) {
+	return srv.s.ClassesStorage().DomainSynonyms()
+}
+
+// setDomainSynonym makes the alias domain argument a synonym of the canonical
+// domain argument, or no longer a synonym if that is empty.
+func (srv *server) setDomainSynonym(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.ClassesStorage().SetDomainSynonym(a[0], a[1]); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// deleteClass deletes the named class.
+func (srv *server) deleteClass(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.ClassesStorage().Delete(a[0]); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// renameClass renames a class from the first to the second name.
+func (srv *server) renameClass(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := eridanus.RenameClass(srv.s, a[0], a[1]); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// deleteParser deletes the named parser.
+func (srv *server) deleteParser(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.ParsersStorage().Delete(a[0]); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// renameParser renames a parser from the first to the second name.
+func (srv *server) renameParser(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := eridanus.RenameParser(srv.s, a[0], a[1]); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// versionedStorage is implemented by the storages recording the versions of
+// their definitions.
+type versionedStorage interface {
+	Versions(string) ([]*eridanus.Revision, error)
+	Diff(name string, a, b uint64) (string, error)
+	Rollback(name string, version uint64, author string) error
+}
+
+// parseVersions parses version numbers given as arguments.
+func parseVersions(args ...string) ([]uint64, error) {
+	vs := make([]uint64, len(args))
+	for i, a := range args {
+		v, err := strconv.ParseUint(a, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", a)
+		}
+		vs[i] = v
+	}
+	return vs, nil
+}
+
+// versions returns the recorded versions of the named definition.
+func (srv *server) versions(vs versionedStorage) commandFunc {
+	return func(cmd *eridanus.Command) (interface{}, error) {
+		a, err := args(cmd, 1)
+		if err != nil {
+			return nil, err
+		}
+		return vs.Versions(a[0])
+	}
+}
+
+// diff returns the differences between two versions of the named definition,
+// given as the name and version arguments.
+func (srv *server) diff(vs versionedStorage) commandFunc {
+	return func(cmd *eridanus.Command) (interface{}, error) {
+		a, err := args(cmd, 3)
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseVersions(a[1:]...)
+		if err != nil {
+			return nil, err
+		}
+		return vs.Diff(a[0], v[0], v[1])
+	}
+}
+
+// rollback restores a prior version of the named definition, given as the
+// name and version arguments, as a new version by the author key.
+func (srv *server) rollback(vs versionedStorage) commandFunc {
+	return func(cmd *eridanus.Command) (interface{}, error) {
+		a, err := args(cmd, 2)
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseVersions(a[1])
+		if err != nil {
+			return nil, err
+		}
+		if err := vs.Rollback(a[0], v[0], cmd.GetKv()["author"]); err != nil {
+			return nil, err
+		}
+		return &eridanus.Command{Cmd: "okay"}, nil
+	}
+}
+
+// exportBundle returns a bundle named by the first argument, of the classes
+// named by the rest.
+func (srv *server) exportBundle(cmd *eridanus.Command) (interface{}, error) {
+	if len(cmd.GetData()) < 2 {
+		return nil, fmt.Errorf("%s: got %d arguments, want at least 2", cmd.GetCmd(), len(cmd.GetData()))
+	}
+	return bundles.ExportBundle(srv.s, cmd.GetData()[0], cmd.GetData()[1:]...)
+}
+
+// importBundle imports the YAML bundle in the argument, resolving names in
+// use as specified by the conflict key.
+func (srv *server) importBundle(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	c, err := bundles.ParseConflict(cmd.GetKv()["conflict"])
+	if err != nil {
+		return nil, err
+	}
+	b, err := bundles.Read(strings.NewReader(a[0]))
+	if err != nil {
+		return nil, err
+	}
+	return bundles.ImportBundle(srv.s, b, c)
+}
+
+// find lists the hashes of items matching the query in the argument, in the
+// tags of the service named by the service key if present.
+func (srv *server) find(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	q, err := eridanus.ParseTagQuery(a[0])
+	if err != nil {
+		return nil, err
+	}
+	ts, err := srv.tagStorage(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Find(q)
+}
+
+// tagStorage provides the tags of the service named by the service key, or
+// of every service if absent.
+func (srv *server) tagStorage(cmd *eridanus.Command) (eridanus.TagStorage, error) {
+	if name := cmd.GetKv()["service"]; name != "" {
+		return srv.s.TagStorage().Service(name)
+	}
+	return srv.s.TagStorage(), nil
+}
+
+// tagServices provides the names of the tag services.
+func (srv *server) tagServices(cmd *eridanus.Command) (interface{}, error) {
+	return srv.s.TagStorage().Services()
+}
+
+// deleteTagService deletes the tags of the named service.
+func (srv *server) deleteTagService(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.TagStorage().DeleteService(a[0]); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// tagCounts provides the number of items with each tag matching the optional
+// pattern argument, in the service named by the service key if present.
+func (srv *server) tagCounts(cmd *eridanus.Command) (interface{}, error) {
+	var pattern string
+	if len(cmd.GetData()) > 0 {
+		pattern = cmd.GetData()[0]
+	}
+	ts, err := srv.tagStorage(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return ts.Counts(pattern)
+}
+
+// rebuildTagIndex rebuilds the tag index from the stored tags.
+func (srv *server) rebuildTagIndex(cmd *eridanus.Command) (interface{}, error) {
+	if err := srv.s.TagStorage().RebuildIndex(); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// showReserved reports if the reserved key asks for reserved tags, such as
+// source: and phash:, which are otherwise left out of those shown.
+func showReserved(cmd *eridanus.Command) bool {
+	return cmd.GetKv()["reserved"] == "true"
+}
+
+// tags provides the tags of the item, in the service named by the service key
+// if present.
+func (srv *server) tags(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := srv.tagStorage(cmd)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := ts.Get(eridanus.IDHash(a[0]))
+	if err != nil {
+		return nil, err
+	}
+	if !showReserved(cmd) {
+		tags = tags.User()
+	}
+	return tags.ToSlice(), nil
+}
+
+// tagRecords provides the tags of the item with where they came from, in the
+// service named by the service key if present.
+func (srv *server) tagRecords(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := srv.tagStorage(cmd)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ts.Records(eridanus.IDHash(a[0]))
+	if err != nil || showReserved(cmd) {
+		return rs, err
+	}
+	var user []*eridanus.TagRecord
+	for _, r := range rs {
+		if !eridanus.Tag(r.GetTag()).Reserved() {
+			user = append(user, r)
+		}
+	}
+	return user, nil
+}
+
+// migrateTags converts comma separated tags, providing the number of items
+// converted.
+func (srv *server) migrateTags(cmd *eridanus.Command) (interface{}, error) {
+	return srv.s.TagStorage().MigrateTags()
+}
+
+// tagSiblings provides the table of tags equivalent to others.
+func (srv *server) tagSiblings(cmd *eridanus.Command) (interface{}, error) {
+	return srv.s.TagStorage().Siblings()
+}
+
+// setTagSibling makes the alias argument equivalent to the canonical tag
+// argument, or no longer an alias if that is empty.
+func (srv *server) setTagSibling(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.TagStorage().SetSibling(eridanus.Tag(a[0]), eridanus.Tag(a[1])); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// setTagSiblingMode sets when tags are canonicalized, READ or PUT.
+func (srv *server) setTagSiblingMode(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 1)
+	if err != nil {
+		return nil, err
+	}
+	mode, ok := eridanus.TagSiblings_Mode_value[strings.ToUpper(a[0])]
+	if !ok {
+		return nil, fmt.Errorf("unknown sibling mode %q", a[0])
+	}
+	if err := srv.s.TagStorage().SetSiblingMode(eridanus.TagSiblings_Mode(mode)); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// tagParents provides the table of tags implying others.
+func (srv *server) tagParents(cmd *eridanus.Command) (interface{}, error) {
+	return srv.s.TagStorage().Parents()
+}
+
+// addTagParent makes the child tag argument imply the parent tag argument.
+func (srv *server) addTagParent(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.TagStorage().AddParent(eridanus.Tag(a[0]), eridanus.Tag(a[1])); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// removeTagParent makes the child tag argument no longer imply the parent tag
+// argument.
+func (srv *server) removeTagParent(cmd *eridanus.Command) (interface{}, error) {
+	a, err := args(cmd, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.s.TagStorage().RemoveParent(eridanus.Tag(a[0]), eridanus.Tag(a[1])); err != nil {
+		return nil, err
+	}
+	return &eridanus.Command{Cmd: "okay"}, nil
+}
+
+// seedDefaults stores the built-in definitions, resolving names in use as
+// specified by the conflict key.
+func (srv *server) seedDefaults(cmd *eridanus.Command) (interface{}, error) {
+	c, err := bundles.ParseConflict(cmd.GetKv()["conflict"])
+	if err != nil {
+		return nil, err
+	}
+	return bundles.SeedDefaults(srv.s, c)
+}
+
+// outdatedDefaults lists stored definitions differing from the built-in ones.
+func (srv *server) outdatedDefaults(cmd *eridanus.Command) (interface{}, error) {
+	return bundles.OutdatedDefaults(srv.s)
+}
+
+// writeExplanations writes a table of how the URL is classified.
+func writeExplanations(w io.Writer, u *url.URL, es []*eridanus.ClassifyExplanation) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, u)
+	for _, e := range es {
+		mark, result := " ", e.URL
+		if e.Selected {
+			mark = "*"
+		}
+		if f := e.Failure; f != nil {
+			switch f.Rule {
+			case eridanus.RulePath:
+				result = fmt.Sprintf("%s[%d]: %s", f.Rule, f.Index, f.Reason)
+			case eridanus.RuleQuery:
+				result = fmt.Sprintf("%s[%s]: %s", f.Rule, f.Param, f.Reason)
+			default:
+				result = fmt.Sprintf("%s: %s", f.Rule, f.Reason)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", mark, e.Class, e.Priority, result)
+	}
+	return tw.Flush()
+}
+
+// writeConflicts writes a table of conflicting classes, marking those of equal priority.
+func writeConflicts(w io.Writer, cs []*eridanus.ClassConflict) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range cs {
+		mark := " "
+		if c.Tie {
+			mark = "="
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", mark, c.First, c.Second, c.URL)
+	}
+	return tw.Flush()
+}
+
+// writeImportReport writes a table of where each imported definition was stored.
+func writeImportReport(w io.Writer, r *bundles.ImportReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, kind := range []struct {
+		name  string
+		names map[string]string
+	}{{"class", r.Classes}, {"parser", r.Parsers}} {
+		var keys []string
+		for k := range kind.names {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			stored := kind.names[k]
+			if stored == "" {
+				stored = "(skipped)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", kind.name, k, stored)
+		}
+	}
+	return tw.Flush()
+}
+
+// writeOutdated writes each outdated definition with its differences from the
+// built-in definition.
+func writeOutdated(w io.Writer, outdated []*bundles.Outdated) error {
+	for _, o := range outdated {
+		if _, err := fmt.Fprintf(w, "%s %q (bundle %s, version %d)\n%s", o.Kind, o.Name, o.Bundle, o.Version, o.Diff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
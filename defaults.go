@@ -0,0 +1,63 @@
+package eridanus
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultsFS holds the built-in definitions, one bundle per file.
+//
+//go:embed defaults/*.yaml
+var defaultsFS embed.FS
+
+// DefaultBundles decodes the built-in definition bundles.
+func DefaultBundles() ([]*Bundle, error) {
+	paths, err := fs.Glob(defaultsFS, "defaults/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	var bs []*Bundle
+	for _, p := range paths {
+		f, err := defaultsFS.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		var b Bundle
+		err = yaml.NewDecoder(f).Decode(&b)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		bs = append(bs, &b)
+	}
+	return bs, nil
+}
+
+// DefaultParsers provides default parsers.
+func DefaultParsers() ([]*Parser, error) {
+	bs, err := DefaultBundles()
+	if err != nil {
+		return nil, err
+	}
+	var ps []*Parser
+	for _, b := range bs {
+		ps = append(ps, b.GetParsers()...)
+	}
+	return ps, nil
+}
+
+// DefaultClasses provides default classes.
+func DefaultClasses() ([]*URLClass, error) {
+	bs, err := DefaultBundles()
+	if err != nil {
+		return nil, err
+	}
+	var ucs []*URLClass
+	for _, b := range bs {
+		ucs = append(ucs, b.GetClasses()...)
+	}
+	return ucs, nil
+}
@@ -6,15 +6,23 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/improbable-eng/go-httpwares/logging/logrus/ctxlogrus"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/xmlpath.v2"
@@ -52,22 +60,64 @@ type StorageBackend interface {
 	Import(srcPath, key string, move bool) error
 }
 
+// Revision describes a stored version of a class or parser.
+type Revision struct {
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+	Author  string    `json:"author"`
+	Diff    string    `json:"diff"` // from the previous version
+}
+
+// ContentInfo describes stored content.
+type ContentInfo struct {
+	Size     int64     `json:"size" yaml:"size"`
+	MIME     string    `json:"mime" yaml:"mime"`
+	Imported time.Time `json:"imported" yaml:"imported"` // zero if stored before import times were kept
+}
+
 // ClassesStorage stores classes.
 type ClassesStorage interface {
 	Names() ([]string, error)
 	Put(*URLClass) error
+	PutBy(*URLClass, string) error
 	Has(string) bool
 	Get(string) (*URLClass, error)
+	GetAll() ([]*URLClass, error)
 	For(*url.URL) (*URLClass, error)
+	Delete(string) error
+	Rename(from, to string) error
+	Versions(string) ([]*Revision, error)
+	Diff(name string, a, b uint64) (string, error)
+	Rollback(name string, version uint64, author string) error
+	DomainSynonyms() (DomainSynonyms, error)
+	SetDomainSynonym(alias, canonical string) error
+	OnChange(func())
 }
 
 // ParsersStorage stores parsers.
 type ParsersStorage interface {
 	Names() ([]string, error)
 	Put(*Parser) error
+	PutBy(*Parser, string) error
 	Has(string) bool
 	Get(string) (*Parser, error)
-	For(*URLClass) ([]*Parser, error)
+	GetAll() ([]*Parser, error)
+	For(*URLClass, DomainSynonyms) ([]*Parser, error)
+	Delete(string) error
+	Rename(from, to string) error
+	Versions(string) ([]*Revision, error)
+	Diff(name string, a, b uint64) (string, error)
+	Rollback(name string, version uint64, author string) error
+	OnChange(func())
+}
+
+// LoginsStorage stores login scripts.
+type LoginsStorage interface {
+	Names() ([]string, error)
+	Put(*Login) error
+	Has(string) bool
+	Get(string) (*Login, error)
+	For(*url.URL) (*Login, error)
 }
 
 // TagStorage stores tags.
@@ -77,7 +127,35 @@ type TagStorage interface {
 	Has(IDHash) bool
 	Get(IDHash) (Tags, error)
 
-	Find() (IDHashes, error)
+	// Records provides the item's tags with where they came from.
+	Records(IDHash) ([]*TagRecord, error)
+	// Add tags an item, keeping the records of tags it already has.
+	Add(IDHash, ...*TagRecord) error
+	// MigrateTags converts tags stored comma separated, returning the number
+	// of items converted.
+	MigrateTags() (int, error)
+
+	// Siblings provides the table of tags equivalent to others.
+	Siblings() (*TagSiblings, error)
+	// SetSibling makes the alias equivalent to the canonical tag, or no longer
+	// an alias if the canonical tag is empty.
+	SetSibling(alias, canonical Tag) error
+	SetSiblingMode(TagSiblings_Mode) error
+
+	// Service provides the view of a named service's tags, kept apart from
+	// those of other services. The view a Storage provides combines them.
+	Service(name string) (TagStorage, error)
+	Services() ([]string, error)
+	DeleteService(name string) error
+
+	// Parents provides the table of tags implying others.
+	Parents() (*TagParents, error)
+	AddParent(child, parent Tag) error
+	RemoveParent(child, parent Tag) error
+
+	Find(*TagQuery) (IDHashes, error)
+	Counts(pattern string) (map[Tag]int, error)
+	RebuildIndex() error
 }
 
 // ContentStorage stores content.
@@ -86,6 +164,7 @@ type ContentStorage interface {
 	Put(io.Reader) (IDHash, error)
 	Has(IDHash) bool
 	Get(IDHash) (io.ReadCloser, error)
+	Info(IDHash) (*ContentInfo, error)
 
 	Thumbnail(IDHash) (io.ReadCloser, error)
 }
@@ -97,6 +176,10 @@ type FetcherStorage interface {
 	SetResults(*url.URL, *ParseResults) error
 	GetCached(*url.URL) (*http.Response, error)
 	SetCached(*url.URL, *http.Response) error
+	DeleteCached(*url.URL) error
+	GetFixture(*url.URL) (*http.Response, error)
+	SetFixture(*url.URL, *http.Response) error
+	UpdateResults(func(*ParseResults) bool) error
 }
 
 // Storage manages data.
@@ -104,6 +187,7 @@ type Storage interface {
 	Backend() StorageBackend
 	ClassesStorage() ClassesStorage
 	ParsersStorage() ParsersStorage
+	LoginsStorage() LoginsStorage
 	TagStorage() TagStorage
 	ContentStorage() ContentStorage
 	FetcherStorage() FetcherStorage
@@ -160,6 +244,54 @@ func (t Tag) String() string {
 	return string(t)
 }
 
+// Tag services, keeping tags apart by where they came from.
+const (
+	ServiceMyTags     = "my tags"
+	ServiceDownloader = "downloader tags"
+	ServiceSystem     = "system"
+)
+
+// Namespaces reserved for tags of internal use, not shown as user tags and
+// only matched by patterns naming them.
+const (
+	NamespacePHash    = "phash"
+	NamespaceSource   = "source"
+	NamespaceFilename = "filename"
+)
+
+var reservedNamespaces = map[string]bool{
+	NamespacePHash:    true,
+	NamespaceSource:   true,
+	NamespaceFilename: true,
+}
+
+// NewTag provides the tag of the subtag in the namespace, where an empty
+// namespace is none.
+func NewTag(namespace, subtag string) Tag {
+	if namespace == "" && !strings.Contains(subtag, ":") {
+		return Tag(subtag)
+	}
+	return Tag(namespace + ":" + subtag)
+}
+
+// Namespace provides the part of the tag before its first colon, if any.
+func (t Tag) Namespace() string {
+	if i := strings.IndexByte(string(t), ':'); i >= 0 {
+		return string(t[:i])
+	}
+	return ""
+}
+
+// Subtag provides the part of the tag after its namespace.
+func (t Tag) Subtag() string {
+	return string(t[strings.IndexByte(string(t), ':')+1:])
+}
+
+// Reserved indicates if the tag is in a namespace for internal use.
+func (t Tag) Reserved() bool {
+	return reservedNamespaces[strings.ToLower(t.Namespace())]
+}
+
 // Tags is a collection fo metadata.
 type Tags []Tag
 
@@ -188,6 +320,29 @@ func (ts Tags) OmitDuplicates() Tags {
 	return out
 }
 
+// ByNamespace provides the tags in the namespace, where an empty namespace
+// is none.
+func (ts Tags) ByNamespace(namespace string) Tags {
+	var out Tags
+	for _, t := range ts {
+		if t.Namespace() == namespace {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// User provides the tags not in reserved namespaces.
+func (ts Tags) User() Tags {
+	var out Tags
+	for _, t := range ts {
+		if !t.Reserved() {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
 // ToSlice returns a string slice.
 func (ts Tags) ToSlice() []string {
 	var strs []string
@@ -202,6 +357,15 @@ func (ts Tags) String() string {
 	return strings.Join(ts.ToSlice(), ",")
 }
 
+// Records provides records of the tags as from the same source.
+func (ts Tags) Records(source TagRecord_Source, parser, url string) []*TagRecord {
+	var rs []*TagRecord
+	for _, t := range ts.OmitDuplicates() {
+		rs = append(rs, &TagRecord{Tag: t.String(), Source: source, Parser: parser, Url: url})
+	}
+	return rs
+}
+
 // RecoveryHandler allows for handling panics.
 func RecoveryHandler(f func(error)) {
 	switch rerr := recover().(type) {
@@ -215,7 +379,7 @@ func RecoveryHandler(f func(error)) {
 }
 
 // Parse applies provided parsers to the provided input.
-func Parse(ctx context.Context, body string, uc *URLClass, ps []*Parser) (*ParseResults, error) {
+func Parse(ctx context.Context, body string, uc *URLClass, ps []*Parser, ds DomainSynonyms) (*ParseResults, error) {
 	log := ctxlogrus.Extract(ctx).WithField("uc", uc.GetName())
 	pts := ClassifierParserTypes[uc.GetClass()]
 
@@ -242,7 +406,7 @@ func Parse(ctx context.Context, body string, uc *URLClass, ps []*Parser) (*Parse
 				log.Warn(err)
 				continue
 			}
-			if _, err := ApplyClassifier(uc, u); err != nil {
+			if _, err := ApplyClassifier(uc, u, ds); err != nil {
 				// log.Warn(err)
 				continue
 			}
@@ -282,8 +446,9 @@ func ApplyParser(p *Parser, r *ParseResult) (*ParseResult, error) {
 		}
 
 		result := &ParseResult{
-			Type:   p.GetType(),
-			Parser: p.GetName(),
+			Type:          p.GetType(),
+			Parser:        p.GetName(),
+			ParserVersion: p.GetVersion(),
 		}
 		switch op.GetType() {
 		case Parser_Operation_VALUE:
@@ -297,7 +462,7 @@ func ApplyParser(p *Parser, r *ParseResult) (*ParseResult, error) {
 				result.Value = append(result.GetValue(), results...)
 			}
 		case Parser_Operation_REGEX:
-			pattern, err := regexp.Compile(op.GetValue())
+			pattern, err := compileRegexp(op.GetValue())
 			if err != nil {
 				return nil, err
 			}
@@ -306,6 +471,14 @@ func ApplyParser(p *Parser, r *ParseResult) (*ParseResult, error) {
 					result.Value = append(result.GetValue(), m)
 				}
 			}
+		case Parser_Operation_JSON:
+			for _, e := range out.GetValue() {
+				results, err := parseJSON(op.GetValue(), e)
+				if err != nil {
+					return nil, err
+				}
+				result.Value = append(result.GetValue(), results...)
+			}
 		case Parser_Operation_PREFIX:
 			for _, e := range out.GetValue() {
 				result.Value = append(result.GetValue(), op.GetValue()+e)
@@ -355,95 +528,754 @@ func parseHTML(pattern string, html io.Reader) ([]string, error) {
 	return out, nil
 }
 
-// MatchStringMatcher acts similarly to regexp.Match.
+func parseJSON(pattern, data string) ([]string, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{v}
+	if pattern != "" {
+		for _, key := range strings.Split(pattern, ".") {
+			var next []interface{}
+			for _, e := range values {
+				switch e := e.(type) {
+				case map[string]interface{}:
+					if key == "*" {
+						keys := make([]string, 0, len(e))
+						for k := range e {
+							keys = append(keys, k)
+						}
+						sort.Strings(keys)
+						for _, k := range keys {
+							next = append(next, e[k])
+						}
+					} else if ev, ok := e[key]; ok {
+						next = append(next, ev)
+					}
+				case []interface{}:
+					if key == "*" {
+						next = append(next, e...)
+					} else if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(e) {
+						next = append(next, e[i])
+					}
+				}
+			}
+			values = next
+		}
+	}
+
+	var out []string
+	for _, e := range values {
+		switch e := e.(type) {
+		case nil:
+		case string:
+			if len(e) > 0 {
+				out = append(out, e)
+			}
+		case float64, bool:
+			out = append(out, fmt.Sprint(e))
+		default: // objects and arrays are kept as json for further operations
+			b, err := json.Marshal(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, string(b))
+		}
+	}
+	return out, nil
+}
+
+// matcherPatterns are the regular expressions of the shortcut matcher kinds.
+var matcherPatterns = map[StringMatcher_MatcherType]string{
+	StringMatcher_ANY:    `[^/]+`,
+	StringMatcher_ALPHA:  `[A-Za-z]`,
+	StringMatcher_ALPHAS: `[A-Za-z]+`,
+	StringMatcher_DIGIT:  `[0-9]`,
+	StringMatcher_DIGITS: `[0-9]+`,
+	StringMatcher_ALNUM:  `[A-Za-z0-9]`,
+	StringMatcher_ALNUMS: `[A-Za-z0-9]+`,
+}
+
+// legacyMatcherAliases maps the REGEX values that once stood for the shortcut
+// matcher kinds, kept so existing definitions continue to work.
+var legacyMatcherAliases = map[string]StringMatcher_MatcherType{
+	"any":    StringMatcher_ANY,
+	"alpha":  StringMatcher_ALPHA,
+	"alphas": StringMatcher_ALPHAS,
+	"digit":  StringMatcher_DIGIT,
+	"digits": StringMatcher_DIGITS,
+	"alnum":  StringMatcher_ALNUM,
+	"alnums": StringMatcher_ALNUMS,
+}
+
+// regexpCache holds compiled patterns keyed by their source.
+var regexpCache sync.Map
+
+// compileRegexp returns the compiled pattern, compiling it only on first use.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Store(pattern, re)
+	return re, nil
+}
+
+// MatchStringMatcher reports if the matcher accepts the whole of value, or any
+// part of it if the matcher is partial, inverted if the matcher is marked not.
 func MatchStringMatcher(m *StringMatcher, value string) bool {
 	if value == "" {
 		return false
 	}
-	if m.Value == "" {
-		return true
-	}
-	switch m.Type {
+	return matchStringMatcher(m, value) != m.GetNot()
+}
+
+// lower provides the INTEGER lower bound, if there is one.
+func (m *StringMatcher) lower() (int64, bool) {
+	return m.GetMin(), m.GetHasMin() || m.GetMin() != 0
+}
+
+// upper provides the INTEGER upper bound, if there is one.
+func (m *StringMatcher) upper() (int64, bool) {
+	return m.GetMax(), m.GetHasMax() || m.GetMax() != 0
+}
+
+func matchStringMatcher(m *StringMatcher, value string) bool {
+	switch mType := matcherType(m); mType {
 	default:
+		if pattern, ok := matcherPatterns[mType]; ok {
+			return matchRegexp(pattern, m.GetPartial(), value)
+		}
 		logrus.Error("match has no defined type")
 		return false
 	case StringMatcher_EXACT:
-		return m.Value == value
+		return m.GetValue() == "" || m.GetValue() == value
 	case StringMatcher_REGEX:
-		pattern, ok := map[string]string{
-			"any":    `[^/]+`,
-			"alpha":  `[A-Za-z]`,
-			"alphas": `[A-Za-z]+`,
-			"digit":  `[0-9]`,
-			"digits": `[0-9]+`,
-			"alnum":  `[A-Za-z0-9]`,
-			"alnums": `[A-Za-z0-9]+`,
-		}[m.Value]
-		if !ok {
-			pattern = m.Value
+		return m.GetValue() == "" || matchRegexp(m.GetValue(), m.GetPartial(), value)
+	case StringMatcher_GLOB:
+		if m.GetValue() == "" {
+			return true
 		}
-		match, err := regexp.MatchString(pattern, value)
+		match, err := path.Match(m.GetValue(), value)
 		if err != nil {
 			logrus.Error(err)
 			return false
 		}
 		return match
+	case StringMatcher_INTEGER:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		if min, ok := m.lower(); ok && n < min {
+			return false
+		}
+		if max, ok := m.upper(); ok && n > max {
+			return false
+		}
+		return true
+	case StringMatcher_ONE_OF:
+		for _, v := range m.GetValues() {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// matcherType returns the matcher's type, resolving legacy REGEX aliases.
+func matcherType(m *StringMatcher) StringMatcher_MatcherType {
+	if m.GetType() == StringMatcher_REGEX {
+		if alias, ok := legacyMatcherAliases[m.GetValue()]; ok {
+			return alias
+		}
+	}
+	return m.GetType()
+}
+
+// matcherRegexp compiles pattern, anchored to the whole value unless partial.
+func matcherRegexp(pattern string, partial bool) (*regexp.Regexp, error) {
+	if !partial {
+		pattern = `^(?:` + pattern + `)$`
+	}
+	return compileRegexp(pattern)
+}
+
+func matchRegexp(pattern string, partial bool, value string) bool {
+	re, err := matcherRegexp(pattern, partial)
+	if err != nil {
+		logrus.Error(err)
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// ValidateName checks that a class or parser name is usable as a storage key.
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("no name")
+	case name == "." || name == "..":
+		return fmt.Errorf("name %q is reserved", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("name %q contains a path separator", name)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return fmt.Errorf("name %q contains a control character", name)
+	}
+	return nil
+}
+
+// RenameClass renames a class, updating the class of stored parse results.
+func RenameClass(s Storage, from, to string) error {
+	if err := s.ClassesStorage().Rename(from, to); err != nil {
+		return err
+	}
+	return s.FetcherStorage().UpdateResults(func(rs *ParseResults) bool {
+		var changed bool
+		for _, r := range rs.GetResults() {
+			if r.GetUclass() == from {
+				r.Uclass, changed = to, true
+			}
+		}
+		return changed
+	})
+}
+
+// RenameParser renames a parser, updating the parser of stored parse results.
+func RenameParser(s Storage, from, to string) error {
+	if err := s.ParsersStorage().Rename(from, to); err != nil {
+		return err
+	}
+	return s.FetcherStorage().UpdateResults(func(rs *ParseResults) bool {
+		var changed bool
+		for _, r := range rs.GetResults() {
+			if r.GetParser() == from {
+				r.Parser, changed = to, true
+			}
+		}
+		return changed
+	})
+}
+
+// UpgradeURLClass provides a copy of the URLClass with REGEX matchers whose
+// value is a legacy alias, such as "digits", replaced by the typed matcher.
+func UpgradeURLClass(uc *URLClass) *URLClass {
+	uc = proto.Clone(uc).(*URLClass)
+	upgrade := func(m *StringMatcher) {
+		if mType := matcherType(m); mType != m.GetType() {
+			m.Type, m.Value = mType, ""
+		}
+	}
+	for _, m := range uc.GetPath() {
+		upgrade(m)
 	}
+	for _, m := range uc.GetQuery() {
+		upgrade(m)
+	}
+	return uc
 }
 
-// Classify returns the highest priority matching URLClass and the URL's normalized form.
-func Classify(u *url.URL, ucs []*URLClass) (*URLClass, *url.URL, error) {
-	var ucKeep *URLClass
-	var urlKeep *url.URL
+// ValidateURLClass checks that all of a URLClass's matchers are well formed,
+// and flags those which are ambiguous.
+func ValidateURLClass(uc *URLClass) error {
+	var problems []string
+	if err := ValidateName(uc.GetName()); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if uc.GetDomain() == "" {
+		problems = append(problems, "no domain")
+	}
+	for i, m := range uc.GetPath() {
+		for _, p := range validateStringMatcher(m) {
+			problems = append(problems, fmt.Sprintf("path[%d]: %s", i, p))
+		}
+		if m.Multiple != nil || m.GetIgnore() {
+			problems = append(problems, fmt.Sprintf("path[%d]: multiple and ignore only apply to query params", i))
+		}
+	}
+	var keys []string
+	for k := range uc.GetQuery() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, p := range validateStringMatcher(uc.GetQuery()[k]) {
+			problems = append(problems, fmt.Sprintf("query[%s]: %s", k, p))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("url class %q: %s", uc.GetName(), strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateStringMatcher(m *StringMatcher) []string {
+	var problems []string
+	mType := matcherType(m)
+	if mType != m.GetType() {
+		problems = append(problems, fmt.Sprintf("regex %q is ambiguous, use the %v type", m.GetValue(), mType))
+	}
+	switch mType {
+	default:
+		if _, ok := matcherPatterns[mType]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown type %v", mType))
+		}
+	case StringMatcher_EXACT:
+	case StringMatcher_REGEX:
+		re, err := matcherRegexp(m.GetValue(), m.GetPartial())
+		if err != nil {
+			problems = append(problems, err.Error())
+			break
+		}
+		if re.MatchString("") {
+			problems = append(problems, fmt.Sprintf("regex %q matches an empty value", m.GetValue()))
+		}
+	case StringMatcher_GLOB:
+		if _, err := path.Match(m.GetValue(), ""); err != nil {
+			problems = append(problems, fmt.Sprintf("glob %q: %v", m.GetValue(), err))
+		}
+	case StringMatcher_INTEGER:
+		min, hasMin := m.lower()
+		max, hasMax := m.upper()
+		if hasMin && hasMax && min > max {
+			problems = append(problems, fmt.Sprintf("min %d is greater than max %d", min, max))
+		}
+	case StringMatcher_ONE_OF:
+		if len(m.GetValues()) == 0 {
+			problems = append(problems, "no values to match one of")
+		}
+	}
+	if m.GetPartial() && mType != StringMatcher_REGEX && matcherPatterns[mType] == "" {
+		problems = append(problems, fmt.Sprintf("partial has no effect on %v", mType))
+	}
+	if len(problems) == 0 && m.GetDefault() != "" && !MatchStringMatcher(m, m.GetDefault()) {
+		problems = append(problems, fmt.Sprintf("default %q does not match", m.GetDefault()))
+	}
+	return problems
+}
+
+// Classify returns the first matching URLClass in the order of SortURLClasses,
+// the URL's normalized form, and any tags derived from the normalized URL.
+func Classify(u *url.URL, ucs []*URLClass, ds DomainSynonyms) (*URLClass, *url.URL, Tags, error) {
+	ucs = append([]*URLClass(nil), ucs...)
+	SortURLClasses(ucs)
 	for _, uc := range ucs {
-		if ucKeep != nil && ucKeep.GetPriority() >= uc.GetPriority() {
+		nu, err := ApplyClassifier(uc, u, ds)
+		if err != nil {
 			continue
 		}
-		nu, err := ApplyClassifier(uc, u)
+		return uc, nu, URLTags(uc, nu), nil
+	}
+	return nil, nil, nil, fmt.Errorf("no classifier for %s", u)
+}
+
+// SortURLClasses orders classes by precedence: highest priority first, then the
+// most specific (more path matchers, then an exact domain before subdomains),
+// then by name.
+func SortURLClasses(ucs []*URLClass) {
+	sort.SliceStable(ucs, func(i, j int) bool { return classBefore(ucs[i], ucs[j]) })
+}
+
+func classBefore(a, b *URLClass) bool {
+	if a.GetPriority() != b.GetPriority() {
+		return a.GetPriority() > b.GetPriority()
+	}
+	if len(a.GetPath()) != len(b.GetPath()) {
+		return len(a.GetPath()) > len(b.GetPath())
+	}
+	if a.GetMatchSubdomain() != b.GetMatchSubdomain() {
+		return !a.GetMatchSubdomain()
+	}
+	return a.GetName() < b.GetName()
+}
+
+// ClassConflict is a pair of classes which both match an example URL, of
+// which First is selected by Classify.
+type ClassConflict struct {
+	First  string `json:"first"`
+	Second string `json:"second"`
+	URL    string `json:"url"`
+	Tie    bool   `json:"tie"` // equal priority, resolved by specificity or name
+}
+
+// FindClassConflicts reports each pair of classes which both match one of
+// either's example URLs.
+func FindClassConflicts(ucs []*URLClass, ds DomainSynonyms) []*ClassConflict {
+	ucs = append([]*URLClass(nil), ucs...)
+	SortURLClasses(ucs)
+	var out []*ClassConflict
+	for i, a := range ucs {
+		for _, b := range ucs[i+1:] {
+			for _, raw := range append(append([]string(nil), a.GetExamples()...), b.GetExamples()...) {
+				u, err := url.Parse(raw)
+				if err != nil {
+					continue
+				}
+				if _, err := ApplyClassifier(a, u, ds); err != nil {
+					continue
+				}
+				if _, err := ApplyClassifier(b, u, ds); err != nil {
+					continue
+				}
+				out = append(out, &ClassConflict{
+					First:  a.GetName(),
+					Second: b.GetName(),
+					URL:    raw,
+					Tie:    a.GetPriority() == b.GetPriority(),
+				})
+				break
+			}
+		}
+	}
+	return out
+}
+
+// The rules of a URLClass which a URL may fail.
+const (
+	RuleDomain = "domain"
+	RulePath   = "path"
+	RuleQuery  = "query"
+)
+
+// ClassifierError describes the first rule of a URLClass that a URL failed.
+type ClassifierError struct {
+	Class  string `json:"class"`
+	Rule   string `json:"rule"`
+	Index  int    `json:"index"`           // path segment index, for path rules
+	Param  string `json:"param,omitempty"` // query parameter, for query rules
+	Reason string `json:"reason"`
+}
+
+func classifierErrorf(uc *URLClass, rule, format string, args ...interface{}) *ClassifierError {
+	return &ClassifierError{Class: uc.GetName(), Rule: rule, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *ClassifierError) Error() string {
+	return fmt.Sprintf("url class %q: %s", e.Class, e.Reason)
+}
+
+// ClassifyExplanation describes the outcome of applying a URLClass to a URL.
+type ClassifyExplanation struct {
+	Class    string           `json:"class"`
+	Priority uint64           `json:"priority"`
+	Matched  bool             `json:"matched"`
+	Selected bool             `json:"selected"`          // the class Classify would return
+	URL      string           `json:"url,omitempty"`     // the normalized URL, if matched
+	Failure  *ClassifierError `json:"failure,omitempty"` // the first failed rule, if not matched
+}
+
+// ExplainClassify applies every URLClass to the URL in the order of
+// SortURLClasses, reporting why each did or did not match and which would be
+// selected by Classify.
+func ExplainClassify(u *url.URL, ucs []*URLClass, ds DomainSynonyms) []*ClassifyExplanation {
+	ucs = append([]*URLClass(nil), ucs...)
+	SortURLClasses(ucs)
+	var out []*ClassifyExplanation
+	var selected bool
+	for _, uc := range ucs {
+		e := &ClassifyExplanation{Class: uc.GetName(), Priority: uc.GetPriority()}
+		out = append(out, e)
+		nu, err := ApplyClassifier(uc, u, ds)
 		if err != nil {
+			if !errors.As(err, &e.Failure) {
+				e.Failure = &ClassifierError{Class: uc.GetName(), Reason: err.Error()}
+			}
 			continue
 		}
-		ucKeep, urlKeep = uc, nu
+		e.Matched, e.URL = true, nu.String()
+		e.Selected, selected = !selected, true
+	}
+	return out
+}
+
+// URLTags returns tags for the values of a normalized URL's path segments and
+// query params whose matchers specify a tag namespace.
+func URLTags(uc *URLClass, nu *url.URL) Tags {
+	var tags Tags
+	addTag := func(ns, value string) {
+		ns = strings.TrimSuffix(ns, ":") // "creator:" names the same namespace as "creator"
+		if v, err := url.PathUnescape(value); err == nil {
+			value = v
+		}
+		if value != "" {
+			tags = append(tags, Tag(strings.ToLower(ns+":"+value)))
+		}
+	}
+
+	pathParts := strings.Split(strings.TrimPrefix(nu.EscapedPath(), "/"), "/")
+	for i, m := range uc.GetPath() {
+		if m.GetTagNamespace() != "" && i < len(pathParts) {
+			addTag(m.GetTagNamespace(), pathParts[i])
+		}
 	}
-	if ucKeep != nil && urlKeep != nil {
-		return ucKeep, urlKeep, nil
+
+	q := nu.Query()
+	keys := make([]string, 0, len(uc.GetQuery()))
+	for k := range uc.GetQuery() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if ns := uc.GetQuery()[k].GetTagNamespace(); ns != "" {
+			for _, v := range q[k] {
+				addTag(ns, v)
+			}
+		}
 	}
-	return nil, nil, fmt.Errorf("no classifier for %s", u)
+	return tags
+}
+
+// DomainSynonyms maps alias domains to the canonical domains they stand for;
+// hosts under an alias are treated as being under its canonical domain when
+// classifying. A nil table has no synonyms.
+type DomainSynonyms map[string]string
+
+// CanonicalHost rewrites a hostname under a synonym domain to be under the
+// canonical domain instead, preserving any subdomain.
+func (ds DomainSynonyms) CanonicalHost(host string) string {
+	var keep string
+	for alias, canonical := range ds {
+		if canonical == "" || canonical == alias {
+			continue
+		}
+		if host != alias && !strings.HasSuffix(host, "."+alias) {
+			continue
+		}
+		if len(alias) > len(keep) { // the most specific alias wins
+			keep = alias
+		}
+	}
+	if keep == "" {
+		return host
+	}
+	return strings.TrimSuffix(host, keep) + ds[keep]
+}
+
+// matchClassDomain checks the hostname against the class's domains, returning
+// the hostname normalized to the class's canonical domain.
+func matchClassDomain(uc *URLClass, host string) (string, error) {
+	for _, domain := range append([]string{uc.GetDomain()}, uc.GetAltDomains()...) {
+		if host == domain {
+			return uc.GetDomain(), nil
+		}
+		if !uc.GetMatchSubdomain() || !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+		// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L2774
+		if !uc.GetAllowSubdomain() {
+			return uc.GetDomain(), nil
+		}
+		return strings.TrimSuffix(host, domain) + uc.GetDomain(), nil
+	}
+	if !uc.GetMatchSubdomain() {
+		return "", classifierErrorf(uc, RuleDomain, "domain mismatch: got %s, want %s", host, uc.GetDomain())
+	}
+	return "", classifierErrorf(uc, RuleDomain, "subdomain mismatch: got %s, want %s", host, "."+uc.GetDomain())
+}
+
+var urlTemplatePattern = regexp.MustCompile(`\{([a-z]+)(?:\.([^}]+))?\}`)
+
+// TransformURL returns the URL to fetch in place of the provided URL, as
+// specified by the class's api_url, or the normalized URL if none is set.
+//
+// The api_url is a template of which {scheme}, {host}, {path.N} (the Nth
+// normalized path segment, from 0) and {query.KEY} are expanded. A relative
+// result is resolved against the URL from FetchURL.
+func TransformURL(uc *URLClass, u *url.URL, ds DomainSynonyms) (*url.URL, error) {
+	nu, err := FetchURL(uc, u, ds)
+	if err != nil {
+		return nil, err
+	}
+	if uc.GetApiUrl() == "" {
+		return nu, nil
+	}
+
+	pathParts := strings.Split(strings.TrimPrefix(nu.EscapedPath(), "/"), "/")
+	q := nu.Query()
+	var terr error
+	raw := urlTemplatePattern.ReplaceAllStringFunc(uc.GetApiUrl(), func(m string) string {
+		sm := urlTemplatePattern.FindStringSubmatch(m)
+		switch sm[1] {
+		case "scheme":
+			return nu.Scheme
+		case "host":
+			return nu.Host
+		case "path":
+			if i, err := strconv.Atoi(sm[2]); err == nil && i >= 0 && i < len(pathParts) {
+				return pathParts[i]
+			}
+		case "query":
+			if vs, ok := q[sm[2]]; ok && len(vs) > 0 {
+				return url.QueryEscape(vs[0])
+			}
+		}
+		terr = fmt.Errorf("unable to expand %s in api_url of %q for %s", m, uc.GetName(), nu)
+		return m
+	})
+	if terr != nil {
+		return nil, terr
+	}
+	return nu.Parse(raw)
+}
+
+// normalizeQuery returns the params of q specified by the class's query and
+// query_mode, with defaults applied, omitting those marked ignore unless fetch.
+func normalizeQuery(uc *URLClass, q url.Values, fetch bool) (url.Values, error) {
+	out := make(url.Values)
+	keys := make([]string, 0, len(uc.GetQuery()))
+	for k := range uc.GetQuery() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m := uc.GetQuery()[k]
+		vs, ok := q[k]
+		if !ok {
+			if m.GetIgnore() {
+				continue
+			}
+			if m.GetDefault() == "" {
+				err := classifierErrorf(uc, RuleQuery, "no default for param %q", k)
+				err.Param = k
+				return nil, err
+			}
+			vs = []string{m.GetDefault()}
+		}
+		for i, v := range vs {
+			if !MatchStringMatcher(m, v) {
+				err := classifierErrorf(uc, RuleQuery, "query param mismatch: %s[%d]=%q %v", k, i, v, m)
+				err.Param = k
+				return nil, err
+			}
+		}
+		if m.Multiple != nil && !m.GetMultiple() {
+			vs = vs[:1]
+		}
+		if m.GetIgnore() && !fetch {
+			continue
+		}
+		out[k] = vs
+	}
+
+	keys = keys[:0]
+	for k := range q {
+		if _, ok := uc.GetQuery()[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch uc.GetQueryMode() {
+		case URLClass_KEEP_UNKNOWN:
+			out[k] = q[k]
+		case URLClass_FORBID_UNKNOWN:
+			err := classifierErrorf(uc, RuleQuery, "unknown param %q", k)
+			err.Param = k
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// pathSegments splits an escaped path into segments normalized as specified by
+// the class, and reports if the path had a trailing slash.
+func pathSegments(uc *URLClass, escaped string) ([]string, bool) {
+	escaped = strings.TrimPrefix(escaped, "/")
+	trailing := strings.HasSuffix(escaped, "/")
+	escaped = strings.TrimSuffix(escaped, "/")
+	if escaped == "" {
+		return nil, false
+	}
+	var segs []string
+	for _, seg := range strings.Split(escaped, "/") {
+		if seg == "" && !uc.GetKeepEmptySegments() {
+			continue
+		}
+		if !uc.GetKeepEncoding() {
+			seg = normalizeEscapes(seg)
+		}
+		segs = append(segs, seg)
+	}
+	return segs, trailing
+}
+
+// normalizeEscapes uppercases the hex digits of percent-escapes and decodes
+// those of unreserved characters, leaving all else, such as sub-delims, as is.
+func normalizeEscapes(seg string) string {
+	if !strings.Contains(seg, "%") {
+		return seg
+	}
+	var b strings.Builder
+	for i := 0; i < len(seg); i++ {
+		if seg[i] != '%' || i+2 >= len(seg) {
+			b.WriteByte(seg[i])
+			continue
+		}
+		v, err := strconv.ParseUint(seg[i+1:i+3], 16, 8)
+		if err != nil {
+			b.WriteByte(seg[i])
+			continue
+		}
+		if c := byte(v); 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(seg[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
 }
 
 // ApplyClassifier applies a classifier to a URL, returning a normalized url or an error if the classifier doesn't apply.
-func ApplyClassifier(uc *URLClass, ou *url.URL) (*url.URL, error) {
+// Hosts under a domain synonym of ds are matched as under its canonical domain.
+func ApplyClassifier(uc *URLClass, ou *url.URL, ds DomainSynonyms) (*url.URL, error) {
+	return applyClassifier(uc, ou, ds, false)
+}
+
+// FetchURL applies a classifier to a URL as ApplyClassifier does, but retains
+// query params marked ignore, for use in fetching.
+func FetchURL(uc *URLClass, ou *url.URL, ds DomainSynonyms) (*url.URL, error) {
+	return applyClassifier(uc, ou, ds, true)
+}
+
+func applyClassifier(uc *URLClass, ou *url.URL, ds DomainSynonyms, fetch bool) (*url.URL, error) {
 	u := url.URL(*ou)
 
 	if u.Scheme != "https" && !uc.GetAllowHttp() {
 		u.Scheme = "https"
 	}
 
+	if !uc.GetKeepFragment() {
+		u.Fragment = ""
+	}
+
 	// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L3313
-	// Somehow take synonym domains into account...
-	// possibly allow specifying multiple domains
-	if u.Hostname() != uc.GetDomain() {
-		if !uc.MatchSubdomain {
-			return nil, fmt.Errorf("domain mismatch: got %s, want %s", u.Hostname(), uc.GetDomain())
-		}
-		sDomain := "." + uc.Domain
-		if !strings.HasSuffix(u.Hostname(), sDomain) {
-			return nil, fmt.Errorf("subdomain mismatch: got %s, want %s", u.Hostname(), sDomain)
-		}
-		// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L2774
-		if !uc.AllowSubdomain {
-			u.Host = uc.Domain
+	host, err := matchClassDomain(uc, ds.CanonicalHost(strings.ToLower(u.Hostname())))
+	if err != nil {
+		return nil, err
+	}
+	if host != u.Hostname() {
+		if port := u.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
 		}
+		u.Host = host
 	}
 
 	// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L3328
 	// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L2795
 	var cp []string
-	pathParts := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	pathParts, trailing := pathSegments(uc, u.EscapedPath())
 	for i, m := range uc.GetPath() {
 		if i < len(pathParts) {
 			if !MatchStringMatcher(m, pathParts[i]) {
-				return nil, fmt.Errorf("path segment mismatch: got %q, want %v", pathParts[i], m)
+				err := classifierErrorf(uc, RulePath, "path segment mismatch: got %q, want %v", pathParts[i], m)
+				err.Index = i
+				return nil, err
 			}
 			cp = append(cp, pathParts[i])
 			continue
@@ -452,35 +1284,26 @@ func ApplyClassifier(uc *URLClass, ou *url.URL) (*url.URL, error) {
 			cp = append(cp, m.Default)
 			continue
 		}
-		return nil, fmt.Errorf("path length mismatch: got %d, want %d", len(pathParts), len(uc.GetPath()))
+		err := classifierErrorf(uc, RulePath, "path length mismatch: got %d, want %d", len(pathParts), len(uc.GetPath()))
+		err.Index = i
+		return nil, err
 	}
 	u.RawPath = "/" + strings.Join(cp, "/")
+	if trailing && len(cp) > 0 && uc.GetKeepTrailingSlash() {
+		u.RawPath += "/"
+	}
+	u.Path = u.RawPath
+	if p, err := url.PathUnescape(u.RawPath); err == nil {
+		u.Path = p
+	}
 
 	// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L2842
 	// https://github.com/hydrusnetwork/hydrus/blob/1976391fd0a37c9caf607127b7a9a2d86a197d3c/hydrus/client/networking/ClientNetworkingDomain.py#L3358
-	q := u.Query()
-	for k, m := range uc.GetQuery() {
-		if vs, ok := q[k]; ok {
-			for i, v := range vs {
-				if !MatchStringMatcher(m, v) {
-					return nil, fmt.Errorf("query param mismatch: %s[%d]=%q %v", k, i, v, m)
-				}
-			}
-			continue
-		}
-		if m.Default == "" {
-			return nil, fmt.Errorf("no default for param %q", k)
-		}
-		q.Set(k, m.Default)
-	}
-	// remove any params remaining not specified in the classifier
-	for k := range q {
-		if _, ok := uc.GetQuery()[k]; !ok {
-			q.Del(k)
-		}
+	q, err := normalizeQuery(uc, u.Query(), fetch)
+	if err != nil {
+		return nil, err
 	}
-	// Do I need to sort this to avoid random/hash ordering?
-	u.RawQuery = q.Encode()
+	u.RawQuery = q.Encode() // sorted by key
 
 	return &u, nil
 }
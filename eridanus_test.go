@@ -3,8 +3,11 @@ package eridanus
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 )
 
 func TestGenerateIDHash(t *testing.T) {
@@ -110,6 +113,48 @@ func TestTagsTagsFromString(t *testing.T) {
 	}
 }
 
+func TestTagNamespace(t *testing.T) {
+	for i, test := range []struct {
+		namespace, subtag string
+		tag               Tag
+		reserved          bool
+	}{
+		{"creator", "calm", "creator:calm", false},
+		{"", "cat", "cat", false},
+		{"", ":)", "::)", false},
+		{"title", "a: b", "title:a: b", false},
+		{"source", "http://example.com/", "source:http://example.com/", true},
+		{"PHash", "8000", "PHash:8000", true},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			tag := NewTag(test.namespace, test.subtag)
+			if tag != test.tag {
+				t.Errorf("NewTag: got %q, want %q", tag, test.tag)
+			}
+			if got := tag.Namespace(); got != test.namespace {
+				t.Errorf("Namespace: got %q, want %q", got, test.namespace)
+			}
+			if got := tag.Subtag(); got != test.subtag {
+				t.Errorf("Subtag: got %q, want %q", got, test.subtag)
+			}
+			if got := tag.Reserved(); got != test.reserved {
+				t.Errorf("Reserved: got %v, want %v", got, test.reserved)
+			}
+		})
+	}
+
+	tags := Tags{"creator:calm", "cat", "creator:other", "source:x"}
+	if got, want := tags.ByNamespace("creator"), (Tags{"creator:calm", "creator:other"}); fmt.Sprint(got.ToSlice()) != fmt.Sprint(want.ToSlice()) {
+		t.Errorf("ByNamespace: got %q, want %q", got.ToSlice(), want.ToSlice())
+	}
+	if got, want := tags.ByNamespace(""), (Tags{"cat"}); fmt.Sprint(got.ToSlice()) != fmt.Sprint(want.ToSlice()) {
+		t.Errorf("ByNamespace: got %q, want %q", got.ToSlice(), want.ToSlice())
+	}
+	if got, want := tags.User(), (Tags{"creator:calm", "cat", "creator:other"}); fmt.Sprint(got.ToSlice()) != fmt.Sprint(want.ToSlice()) {
+		t.Errorf("User: got %q, want %q", got.ToSlice(), want.ToSlice())
+	}
+}
+
 func TestTagsOmitDuplicates(t *testing.T) {
 	var hs Tags
 	for _, e := range []string{"a", "b", "c", "c", "c"} {
@@ -174,3 +219,646 @@ func TestRecoveryHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestMatchStringMatcher(t *testing.T) {
+	for i, test := range []struct {
+		m     *StringMatcher
+		value string
+		want  bool
+	}{
+		{&StringMatcher{Value: "posts"}, "posts", true},
+		{&StringMatcher{Value: "posts"}, "post", false},
+		{&StringMatcher{Value: "posts", Not: true}, "post", true},
+		{&StringMatcher{}, "anything", true},
+		{&StringMatcher{}, "", false},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `^p\d+$`}, "p12", true},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `[`}, "[", false},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `\d+`}, "abc123", false},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `\d+`, Partial: true}, "abc123", true},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `a|b`}, "ab", false},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: "digits"}, "12", true}, // legacy alias
+		{&StringMatcher{Type: StringMatcher_GLOB, Value: "*.png"}, "a.png", true},
+		{&StringMatcher{Type: StringMatcher_GLOB, Value: "*.png"}, "a.jpg", false},
+		{&StringMatcher{Type: StringMatcher_GLOB, Value: "img_??"}, "img_01", true},
+		{&StringMatcher{Type: StringMatcher_INTEGER}, "-4", true},
+		{&StringMatcher{Type: StringMatcher_INTEGER}, "4a", false},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: 1, Max: 10}, "10", true},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: 1, Max: 10}, "11", false},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: 1}, "0", false},
+		{&StringMatcher{Type: StringMatcher_INTEGER, HasMin: true}, "-1", false},
+		{&StringMatcher{Type: StringMatcher_INTEGER, HasMin: true}, "0", true},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: -5, HasMax: true}, "1", false},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: -5, HasMax: true}, "-5", true},
+		{&StringMatcher{Type: StringMatcher_ONE_OF, Values: []string{"safe", "questionable"}}, "safe", true},
+		{&StringMatcher{Type: StringMatcher_ONE_OF, Values: []string{"safe", "questionable"}}, "explicit", false},
+		{&StringMatcher{Type: StringMatcher_ONE_OF, Values: []string{"safe"}, Not: true}, "explicit", true},
+		{&StringMatcher{Type: StringMatcher_ANY}, "a b", true},
+		{&StringMatcher{Type: StringMatcher_ALPHAS}, "abc", true},
+		{&StringMatcher{Type: StringMatcher_DIGITS}, "abc", false},
+		{&StringMatcher{Type: StringMatcher_DIGITS, Not: true}, "abc", true},
+		{&StringMatcher{Type: StringMatcher_ALNUMS}, "-", false},
+		{&StringMatcher{Type: StringMatcher_DIGIT}, "12", false},
+		{&StringMatcher{Type: StringMatcher_DIGIT, Partial: true}, "a1", true},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if got := MatchStringMatcher(test.m, test.value); got != test.want {
+				t.Errorf("MatchStringMatcher(%v, %q): got %v, want %v", test.m, test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for i, test := range []struct {
+		name string
+		ok   bool
+	}{
+		{"Hentai-Foundry Post", true},
+		{"e621 post (api)", true},
+		{"", false},
+		{"..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a\nb", false},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if err := ValidateName(test.name); (err == nil) != test.ok {
+				t.Errorf("ValidateName(%q): got %v, want ok %v", test.name, err, test.ok)
+			}
+		})
+	}
+}
+
+func TestValidateURLClass(t *testing.T) {
+	for i, test := range []struct {
+		m    *StringMatcher
+		want string
+	}{
+		{&StringMatcher{Value: "posts"}, ""},
+		{&StringMatcher{Type: StringMatcher_DIGITS, Default: "1"}, ""},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `[a-z]+\d`}, ""},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `[`}, "missing closing ]"},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: `\d*`}, "matches an empty value"},
+		{&StringMatcher{Type: StringMatcher_REGEX, Value: "digits"}, "use the DIGITS type"},
+		{&StringMatcher{Type: StringMatcher_GLOB, Value: "[a-"}, "syntax error in pattern"},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: 5, Max: 1}, "greater than max"},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: 5, HasMax: true}, "greater than max"},
+		{&StringMatcher{Type: StringMatcher_INTEGER, Min: 5}, ""},
+		{&StringMatcher{Type: StringMatcher_ONE_OF}, "no values"},
+		{&StringMatcher{Value: "a", Partial: true}, "partial has no effect"},
+		{&StringMatcher{Type: StringMatcher_DIGITS, Default: "first"}, "does not match"},
+		{&StringMatcher{Type: 99}, "unknown type"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			uc := &URLClass{Name: "test", Domain: "example.com",
+				Path:  []*StringMatcher{test.m},
+				Query: map[string]*StringMatcher{"q": test.m}}
+			err := ValidateURLClass(uc)
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("ValidateURLClass(%v): %v", test.m, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("ValidateURLClass(%v): got %v, want %q", test.m, err, test.want)
+			}
+			if err != nil && (!strings.Contains(err.Error(), "path[0]") || !strings.Contains(err.Error(), "query[q]")) {
+				t.Errorf("ValidateURLClass(%v): got %v, want path and query flagged", test.m, err)
+			}
+		})
+	}
+}
+
+func TestDefaultBundles(t *testing.T) {
+	bs, err := DefaultBundles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs {
+		for _, uc := range b.GetClasses() {
+			if err := ValidateURLClass(uc); err != nil {
+				t.Errorf("%s: %v", b.GetName(), err)
+			}
+			for _, e := range uc.GetExamples() {
+				u, err := url.Parse(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, _, _, err := Classify(u, b.GetClasses(), nil); err != nil || got.GetName() != uc.GetName() {
+					t.Errorf("%s: Classify(%s): got %q (%v), want %q", b.GetName(), e, got.GetName(), err, uc.GetName())
+				}
+			}
+		}
+		for _, p := range b.GetParsers() {
+			if err := ValidateName(p.GetName()); err != nil || len(p.GetOperations()) == 0 {
+				t.Errorf("%s: parser %q: %v", b.GetName(), p.GetName(), err)
+			}
+		}
+	}
+}
+
+func TestApplyClassifier_Domains(t *testing.T) {
+	synonyms := DomainSynonyms{"e926.net": "e621.net"}
+	path := []*StringMatcher{{Value: "posts"}, {Type: StringMatcher_DIGITS}}
+	alt := &URLClass{Domain: "e621.net", AltDomains: []string{"e-six.net"}, Path: path}
+	sub := &URLClass{Domain: "e621.net", MatchSubdomain: true, AllowSubdomain: true, Path: path}
+	for i, test := range []struct {
+		uc   *URLClass
+		u    string
+		want string
+	}{
+		{alt, "https://e621.net/posts/1", "https://e621.net/posts/1"},
+		{alt, "https://e-six.net/posts/1", "https://e621.net/posts/1"},
+		{alt, "https://e926.net/posts/1", "https://e621.net/posts/1"},
+		{alt, "https://www.e621.net/posts/1", ""},
+		{alt, "https://example.com/posts/1", ""},
+		{sub, "https://static1.e926.net/posts/1", "https://static1.e621.net/posts/1"},
+		{sub, "https://e926.net:8080/posts/1", "https://e621.net:8080/posts/1"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			u, err := url.Parse(test.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nu, err := ApplyClassifier(test.uc, u, synonyms)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("ApplyClassifier(%q): got %q, want error", u, nu)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyClassifier(%q): %v", u, err)
+			}
+			if nu.String() != test.want {
+				t.Errorf("ApplyClassifier(%q): got %q, want %q", u, nu, test.want)
+			}
+		})
+	}
+}
+
+func TestSortURLClasses(t *testing.T) {
+	ucs := []*URLClass{
+		{Name: "b", Domain: "example.com"},
+		{Name: "subdomain", Domain: "example.com", MatchSubdomain: true, Path: []*StringMatcher{{}}},
+		{Name: "a", Domain: "example.com"},
+		{Name: "path", Domain: "example.com", Path: []*StringMatcher{{}}},
+		{Name: "priority", Domain: "example.com", Priority: 1},
+	}
+	SortURLClasses(ucs)
+	var got []string
+	for _, uc := range ucs {
+		got = append(got, uc.GetName())
+	}
+	want := []string{"priority", "path", "subdomain", "a", "b"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFindClassConflicts(t *testing.T) {
+	ucs := []*URLClass{
+		{Name: "post", Domain: "example.com",
+			Path:     []*StringMatcher{{Value: "post"}, {Type: StringMatcher_DIGITS}},
+			Examples: []string{"https://example.com/post/1"}},
+		{Name: "any post", Domain: "example.com",
+			Path:     []*StringMatcher{{Value: "post"}, {Type: StringMatcher_ANY}},
+			Examples: []string{"https://example.com/post/abc"}},
+		{Name: "post page", Domain: "example.com", Priority: 1,
+			Path:  []*StringMatcher{{Value: "post"}, {Type: StringMatcher_DIGITS}},
+			Query: map[string]*StringMatcher{"page": {Type: StringMatcher_DIGITS, Default: "1"}}},
+		{Name: "gallery", Domain: "example.com",
+			Path:     []*StringMatcher{{Value: "gallery"}},
+			Examples: []string{"https://example.com/gallery"}},
+	}
+	var got []string
+	for _, c := range FindClassConflicts(ucs, nil) {
+		got = append(got, fmt.Sprintf("%s/%s %s %v", c.First, c.Second, c.URL, c.Tie))
+	}
+	want := []string{
+		"post page/post https://example.com/post/1 false",
+		"any post/post https://example.com/post/1 true",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExplainClassify(t *testing.T) {
+	ucs := []*URLClass{
+		{Name: "post", Domain: "example.com", Priority: 1,
+			Path: []*StringMatcher{{Value: "post"}, {Type: StringMatcher_DIGITS}}},
+		{Name: "post api", Domain: "example.com", Priority: 2,
+			Path:  []*StringMatcher{{Value: "post"}, {Type: StringMatcher_DIGITS}},
+			Query: map[string]*StringMatcher{"format": {Value: "json"}}},
+		{Name: "any post", Domain: "example.com", Priority: 1,
+			Path: []*StringMatcher{{Value: "post"}, {Type: StringMatcher_ANY}}},
+		{Name: "gallery", Domain: "example.com",
+			Path: []*StringMatcher{{Value: "gallery"}}},
+		{Name: "other", Domain: "example.net"},
+	}
+	u, err := url.Parse("https://example.com/post/abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ExplainClassify(u, ucs, nil)
+	want := []ClassifyExplanation{
+		{Class: "post api", Priority: 2, Failure: &ClassifierError{Class: "post api", Rule: RulePath, Index: 1}},
+		{Class: "any post", Priority: 1, Matched: true, Selected: true, URL: "https://example.com/post/abc"},
+		{Class: "post", Priority: 1, Failure: &ClassifierError{Class: "post", Rule: RulePath, Index: 1}},
+		{Class: "gallery", Failure: &ClassifierError{Class: "gallery", Rule: RulePath, Index: 0}},
+		{Class: "other", Failure: &ClassifierError{Class: "other", Rule: RuleDomain}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ExplainClassify(%q): got %d explanations, want %d", u, len(got), len(want))
+	}
+	for i, w := range want {
+		g := *got[i]
+		if g.Failure != nil {
+			if g.Failure.Reason == "" {
+				t.Errorf("%s: failure has no reason", g.Class)
+			}
+			g.Failure = &ClassifierError{Class: g.Failure.Class, Rule: g.Failure.Rule, Index: g.Failure.Index, Param: g.Failure.Param}
+		}
+		if fmt.Sprint(g.Failure) != fmt.Sprint(w.Failure) {
+			t.Errorf("%s failure: got %+v, want %+v", w.Class, g.Failure, w.Failure)
+		}
+		g.Failure, w.Failure = nil, nil
+		if g != w {
+			t.Errorf("%s: got %+v, want %+v", w.Class, g, w)
+		}
+	}
+
+	u, err = url.Parse("https://example.com/post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = ExplainClassify(u, ucs, nil)
+	if f := got[0].Failure; f == nil || f.Rule != RuleQuery || f.Param != "format" {
+		t.Errorf("post api failure: got %+v, want query format", f)
+	}
+	if !got[1].Selected || !got[2].Matched || got[2].Selected {
+		t.Errorf("selected: got %+v and %+v, want first only", got[1], got[2])
+	}
+}
+
+func TestApplyClassifier_Normalization(t *testing.T) {
+	path := []*StringMatcher{{Value: "user"}, {Type: StringMatcher_ANY}, {Value: "profile"}}
+	uc := &URLClass{Domain: "example.com", Path: path}
+	keep := &URLClass{Domain: "example.com", Path: path,
+		KeepFragment: true, KeepTrailingSlash: true, KeepEncoding: true}
+	for i, test := range []struct {
+		uc   *URLClass
+		u    string
+		want string
+	}{
+		{uc, "https://example.com/user/Calm/profile", "https://example.com/user/Calm/profile"},
+		{uc, "https://example.com/user/Calm/profile/", "https://example.com/user/Calm/profile"},
+		{uc, "https://example.com/user/Calm/profile#top", "https://example.com/user/Calm/profile"},
+		{uc, "https://example.com//user//Calm/profile//", "https://example.com/user/Calm/profile"},
+		{uc, "https://EXAMPLE.com/user/Calm/profile", "https://example.com/user/Calm/profile"},
+		{uc, "https://example.com/user/%43alm/profile", "https://example.com/user/Calm/profile"},
+		{uc, "https://example.com/user/a%2fb/profile", "https://example.com/user/a%2Fb/profile"},
+		{uc, "https://example.com/user/a,b;c/profile", "https://example.com/user/a,b;c/profile"},
+		{uc, "https://example.com/user/a%2cb%7e/profile", "https://example.com/user/a%2Cb~/profile"},
+		{uc, "https://example.com/user/%e3%81%82/profile", "https://example.com/user/%E3%81%82/profile"},
+		{uc, "https://example.com/user/Calm/profile/extra", "https://example.com/user/Calm/profile"},
+		{keep, "https://example.com/user/Calm/profile/#top", "https://example.com/user/Calm/profile/#top"},
+		{keep, "https://example.com/user/%43alm/profile", "https://example.com/user/%43alm/profile"},
+		{&URLClass{Domain: "example.com", Path: path, KeepEmptySegments: true}, "https://example.com/user//Calm/profile", ""},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			u, err := url.Parse(test.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nu, err := ApplyClassifier(test.uc, u, nil)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("ApplyClassifier(%q): got %q, want error", u, nu)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyClassifier(%q): %v", u, err)
+			}
+			if nu.String() != test.want {
+				t.Errorf("ApplyClassifier(%q): got %q, want %q", u, nu, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyClassifier_Query(t *testing.T) {
+	single := false
+	query := map[string]*StringMatcher{
+		"page": {Type: StringMatcher_DIGITS, Default: "1", Multiple: &single},
+		"tags": {Type: StringMatcher_ANY, Default: "all"},
+		"s":    {Type: StringMatcher_ALNUMS, Ignore: true},
+	}
+	strip := &URLClass{Domain: "example.com", Query: query}
+	keep := &URLClass{Domain: "example.com", Query: query, QueryMode: URLClass_KEEP_UNKNOWN}
+	forbid := &URLClass{Domain: "example.com", Query: query, QueryMode: URLClass_FORBID_UNKNOWN}
+	for i, test := range []struct {
+		uc          *URLClass
+		u           string
+		want, fetch string
+	}{
+		{strip, "https://example.com/", "https://example.com/?page=1&tags=all", "https://example.com/?page=1&tags=all"},
+		{strip, "https://example.com/?z=1&page=2&s=abc", "https://example.com/?page=2&tags=all", "https://example.com/?page=2&s=abc&tags=all"},
+		{strip, "https://example.com/?page=2&page=3&tags=a&tags=b", "https://example.com/?page=2&tags=a&tags=b", "https://example.com/?page=2&tags=a&tags=b"},
+		{strip, "https://example.com/?page=2&page=x", "", ""},
+		{strip, "https://example.com/?s=a-b", "", ""},
+		{keep, "https://example.com/?z=1&page=2", "https://example.com/?page=2&tags=all&z=1", "https://example.com/?page=2&tags=all&z=1"},
+		{forbid, "https://example.com/?page=2&s=abc", "https://example.com/?page=2&tags=all", "https://example.com/?page=2&s=abc&tags=all"},
+		{forbid, "https://example.com/?z=1&page=2", "", ""},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			u, err := url.Parse(test.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, apply := range []struct {
+				name string
+				f    func(*URLClass, *url.URL, DomainSynonyms) (*url.URL, error)
+				want string
+			}{
+				{"ApplyClassifier", ApplyClassifier, test.want},
+				{"FetchURL", FetchURL, test.fetch},
+			} {
+				nu, err := apply.f(test.uc, u, nil)
+				if apply.want == "" {
+					if err == nil {
+						t.Errorf("%s(%q): got %q, want error", apply.name, u, nu)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s(%q): %v", apply.name, u, err)
+					continue
+				}
+				if nu.String() != apply.want {
+					t.Errorf("%s(%q): got %q, want %q", apply.name, u, nu, apply.want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyClassifier_Idempotent(t *testing.T) {
+	f := func(segs [3]string, fragment string, upper bool, keep uint8) bool {
+		uc := &URLClass{Domain: "example.com",
+			Path: []*StringMatcher{
+				{Type: StringMatcher_ANY},
+				{Type: StringMatcher_ANY, Default: "b"},
+				{Type: StringMatcher_ANY, Default: "c"},
+			},
+			KeepFragment:      keep&1 != 0,
+			KeepTrailingSlash: keep&2 != 0,
+			KeepEmptySegments: keep&4 != 0,
+			KeepEncoding:      keep&8 != 0,
+		}
+		host := "example.com"
+		if upper {
+			host = "Example.COM"
+		}
+		u := &url.URL{Scheme: "https", Host: host, Path: "/" + strings.Join(segs[:], "/"), Fragment: fragment}
+		nu, err := ApplyClassifier(uc, u, nil)
+		if err != nil {
+			return true // not all generated paths match
+		}
+		ru, err := url.Parse(nu.String())
+		if err != nil {
+			t.Logf("url.Parse(%q): %v", nu, err)
+			return false
+		}
+		nnu, err := ApplyClassifier(uc, ru, nil)
+		if err != nil {
+			t.Logf("ApplyClassifier(%q): %v", ru, err)
+			return false
+		}
+		if nnu.String() != nu.String() {
+			t.Logf("ApplyClassifier(%q): got %q, want %q", ru, nnu, nu)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	synonyms := DomainSynonyms{"example.org": "example.com", "cdn.example.org": "example.net", "example.net": ""}
+	for i, test := range [][2]string{
+		{"example.org", "example.com"},
+		{"www.example.org", "www.example.com"},
+		{"cdn.example.org", "example.net"},
+		{"a.cdn.example.org", "a.example.net"},
+		{"badexample.org", "badexample.org"},
+		{"example.net", "example.net"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if got := synonyms.CanonicalHost(test[0]); got != test[1] {
+				t.Errorf("CanonicalHost(%q): got %q, want %q", test[0], got, test[1])
+			}
+		})
+	}
+}
+
+func TestTransformURL(t *testing.T) {
+	uc := &URLClass{
+		Name:   "post",
+		Domain: "example.com",
+		Path:   []*StringMatcher{{Value: "post"}, {Type: StringMatcher_DIGITS}},
+		Query:  map[string]*StringMatcher{"lang": {Type: StringMatcher_ALPHAS, Default: "en"}},
+	}
+	for i, test := range []struct {
+		api  string
+		u    string
+		want string
+	}{
+		{"", "http://example.com/post/12?x=1", "https://example.com/post/12?lang=en"},
+		{"/api/posts/{path.1}.json", "https://example.com/post/12", "https://example.com/api/posts/12.json"},
+		{"https://api.{host}/v1/{path.0}?id={path.1}&l={query.lang}", "https://example.com/post/12?lang=de",
+			"https://api.example.com/v1/post?id=12&l=de"},
+		{"/api/{path.5}", "https://example.com/post/12", ""},
+		{"/api/{query.missing}", "https://example.com/post/12", ""},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			uc.ApiUrl = test.api
+			u, err := url.Parse(test.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			au, err := TransformURL(uc, u, nil)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("TransformURL(%q): got %q, want error", u, au)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("TransformURL(%q): %v", u, err)
+			}
+			if au.String() != test.want {
+				t.Errorf("TransformURL(%q): got %q, want %q", u, au, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyParser_JSON(t *testing.T) {
+	body := `{"post": {"id": 12, "file": {"url": "/f/12.png"}, "tags": {"general": ["Cat", "hat"], "artist": ["calm"]}}}`
+	for i, test := range []struct {
+		ops  []*Parser_Operation
+		want []string
+	}{
+		{[]*Parser_Operation{{Type: Parser_Operation_JSON, Value: "post.file.url"}}, []string{"/f/12.png"}},
+		{[]*Parser_Operation{{Type: Parser_Operation_JSON, Value: "post.id"}}, []string{"12"}},
+		{[]*Parser_Operation{{Type: Parser_Operation_JSON, Value: "post.tags.*.*"}}, []string{"calm", "cat", "hat"}},
+		{[]*Parser_Operation{{Type: Parser_Operation_JSON, Value: "post.tags.general.1"}}, []string{"hat"}},
+		{[]*Parser_Operation{
+			{Type: Parser_Operation_JSON, Value: "post.tags"},
+			{Type: Parser_Operation_JSON, Value: "artist.0"},
+			{Type: Parser_Operation_PREFIX, Value: "creator:"},
+		}, []string{"creator:calm"}},
+		{[]*Parser_Operation{{Type: Parser_Operation_JSON, Value: "post.missing"}}, nil},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			p := &Parser{Name: "json", Type: ParseResultType_TAG, Operations: test.ops}
+			result, err := ApplyParser(p, &ParseResult{Value: []string{body}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := result.GetValue(); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("ApplyParser: got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClassify_Tags(t *testing.T) {
+	uc := &URLClass{
+		Name:   "post",
+		Domain: "example.com",
+		Path: []*StringMatcher{
+			{Value: "user"},
+			{Type: StringMatcher_ANY, TagNamespace: "creator:"},
+			{Type: StringMatcher_DIGITS, TagNamespace: "post_id"},
+		},
+		Query: map[string]*StringMatcher{
+			"page": {Type: StringMatcher_DIGITS, Default: "1"},
+			"lang": {Type: StringMatcher_ALPHAS, Default: "en", TagNamespace: "language"},
+		},
+	}
+	for i, test := range []struct {
+		u    string
+		want []string
+	}{
+		{"https://example.com/user/Calm/801362", []string{"creator:calm", "post_id:801362", "language:en"}},
+		{"https://example.com/user/Some%20One/1?lang=de&page=2", []string{"creator:some one", "post_id:1", "language:de"}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			u, err := url.Parse(test.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, tags, err := Classify(u, []*URLClass{uc}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tags.ToSlice(); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("Classify(%q) tags: got %v, want %v", u, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTagQuery(t *testing.T) {
+	for i, test := range []struct {
+		query, want string
+		err         bool
+	}{
+		{"creator:calm -rating:explicit", "creator:calm -rating:explicit", false},
+		{"cat OR dog hat", "(cat OR dog) hat", false},
+		{"-(cat OR dog) creator:*", "-(cat OR dog) creator:*", false},
+		{`"blue sky" -(a b)`, `"blue sky" -(a b)`, false},
+		{"system:size>1mb system:mime=image/* system:phash", "system:size>1mb system:mime=image/* system:phash", false},
+		{"hat system:sort=-imported system:limit=10 system:offset=20", "hat system:sort=-imported system:offset=20 system:limit=10", false},
+		{"", "", false},
+		{"cat OR", "", true},
+		{"(cat", "", true},
+		{"-system:limit=1", "", true},
+		{"system:size>big", "", true},
+		{"system:mime<image/png", "", true},
+		{"system:bogus", "", true},
+		{"system:sort=name", "", true},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			q, err := ParseTagQuery(test.query)
+			if (err != nil) != test.err {
+				t.Fatalf("ParseTagQuery(%q): got error %v, want error %v", test.query, err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := q.String(); got != test.want {
+				t.Errorf("ParseTagQuery(%q): got %q, want %q", test.query, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTagQuerySelect(t *testing.T) {
+	now := time.Now()
+	items := []*TagItem{
+		{Hash: "a", Tags: Tags{"creator:calm", "cat", "phash:8000"},
+			Info: &ContentInfo{Size: 2 << 20, MIME: "image/png", Imported: now.Add(-48 * time.Hour)}},
+		{Hash: "b", Tags: Tags{"creator:calm", "dog", "rating:explicit"},
+			Info: &ContentInfo{Size: 1 << 10, MIME: "image/jpeg", Imported: now.Add(-time.Hour)}},
+		{Hash: "c", Tags: Tags{"Creator:Other", "cat"},
+			Info: &ContentInfo{Size: 3 << 20, MIME: "video/webm", Imported: now}},
+		{Hash: "d", Tags: Tags{"hat"}},
+	}
+	yesterday := now.AddDate(0, 0, -1).Format("2006-01-02")
+	twoDaysAgo := now.Add(-48 * time.Hour).Format("2006-01-02") // a's import date
+	for i, test := range []struct {
+		query string
+		want  IDHashes
+	}{
+		{"", IDHashes{"a", "b", "c", "d"}},
+		{"creator:calm -rating:explicit", IDHashes{"a"}},
+		{"creator:*", IDHashes{"a", "b", "c"}},
+		{"creator:o*", IDHashes{"c"}},
+		{"cat OR dog -creator:other", IDHashes{"a", "b"}},
+		{"system:size>1mb", IDHashes{"a", "c"}},
+		{"system:mime=image/*", IDHashes{"a", "b"}},
+		{"system:mime!=image/*", IDHashes{"c"}},
+		{"system:imported>1d", IDHashes{"a"}},
+		{"system:imported<1d", IDHashes{"b", "c"}},
+		{"system:imported>" + yesterday, IDHashes{"b", "c"}},
+		{"system:imported<" + yesterday, IDHashes{"a"}},
+		{"system:imported=" + twoDaysAgo, IDHashes{"a"}},
+		{"system:imported!=" + twoDaysAgo, IDHashes{"b", "c"}},
+		{"system:tags=3", IDHashes{"b"}},
+		{"*8000", IDHashes{}},
+		{"phash:*", IDHashes{"a"}},
+		{"system:phash", IDHashes{"a"}},
+		{"-system:phash", IDHashes{"b", "c", "d"}},
+		{"system:sort=-size", IDHashes{"c", "a", "b", "d"}},
+		{"system:sort=imported system:offset=1 system:limit=2", IDHashes{"a", "b"}},
+		{"system:sort=tags system:limit=1", IDHashes{"d"}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			q, err := ParseTagQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := q.Select(items); fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("%q: got %v, want %v", test.query, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package fetcher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+)
+
+func TestAPIURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/post/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "page should not be fetched", http.StatusTeapot)
+	})
+	mux.HandleFunc("/api/posts/1.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"post": {"tags": ["Cat", "hat"], "related": ["/post/2"]}}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestStorage(t)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{
+		Name: "test api post", Class: eridanus.URLClass_POST, Domain: "127.0.0.1", AllowHttp: true,
+		Path:   []*eridanus.StringMatcher{{Value: "post"}, {Type: eridanus.StringMatcher_DIGITS}},
+		ApiUrl: "/api/posts/{path.1}.json",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*eridanus.Parser{
+		{Name: "test api tags", Type: eridanus.ParseResultType_TAG,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_JSON, Value: "post.tags.*"}},
+			Urls:       []string{srv.URL + "/post/1"}},
+		{Name: "test api follow", Type: eridanus.ParseResultType_FOLLOW,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_JSON, Value: "post.related.*"}},
+			Urls:       []string{srv.URL + "/post/1"}},
+	} {
+		if err := s.ParsersStorage().Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := NewFetcher(s, WithTransport(srv.Client().Transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/post/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.QueueAndWait(req)
+
+	u, err := url.Parse(srv.URL + "/post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.FetcherStorage().GetResults(u)
+	if err != nil {
+		t.Fatalf("GetResults(%q): %v", u, err)
+	}
+	got := make(map[eridanus.ParseResultType][]string)
+	for _, r := range results.GetResults() {
+		got[r.GetType()] = append(got[r.GetType()], r.GetValue()...)
+	}
+	for pType, want := range map[eridanus.ParseResultType][]string{
+		eridanus.ParseResultType_SOURCE: {srv.URL + "/post/1"},
+		eridanus.ParseResultType_TAG:    {"cat", "hat"},
+		eridanus.ParseResultType_FOLLOW: {srv.URL + "/post/2"},
+	} {
+		if fmt.Sprint(got[pType]) != fmt.Sprint(want) {
+			t.Errorf("%v results: got %v, want %v", pType, got[pType], want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package fetcher
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -33,108 +34,70 @@ import (
 
 var maxWorkers = 10
 
-func getAllClasses(s eridanus.ClassesStorage) (vs []*eridanus.URLClass, err error) {
-	names, err := s.Names()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, name := range names {
-		v, err := s.Get(name)
-		if err != nil {
-			return nil, err
-		}
-		vs = append(vs, v)
-	}
-	return
-}
-
-func getAllParsers(s eridanus.ParsersStorage) (vs []*eridanus.Parser, err error) {
-	names, err := s.Names()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, name := range names {
-		v, err := s.Get(name)
-		if err != nil {
-			return nil, err
-		}
-		vs = append(vs, v)
-	}
-	return
-}
-
-func buildClassParserMap(s eridanus.Storage) map[*eridanus.URLClass][]*eridanus.Parser {
-	classes, err := getAllClasses(s.ClassesStorage())
-	if err != nil {
-		return nil
-	}
-
-	parsers, err := getAllParsers(s.ParsersStorage())
-	if err != nil {
-		return nil
-	}
-
-	d := make(map[*eridanus.URLClass][]*eridanus.Parser)
-	for _, uc := range classes {
-		for _, p := range parsers {
-			var good bool
-			for _, su := range p.GetUrls() {
-				u, err := url.Parse(su)
-				if err != nil {
-					continue
-				}
-				if _, err := eridanus.ApplyClassifier(uc, u); err == nil {
-					good = true
-					break
-				}
-			}
-			if good {
-				d[uc] = append(d[uc], p)
-			}
-		}
-	}
-	return d
-}
-
 // Fetcher fetches content from the internet.
 type Fetcher struct {
 	m     *sync.RWMutex
 	s     map[string]*semaphore.Weighted
 	sLock map[string]*sync.Mutex
 
-	d  map[*eridanus.URLClass][]*eridanus.Parser
+	r  *eridanus.Registry
 	rt http.RoundTripper
 
-	p *pond.WorkerPool
-	c *http.Client
+	p  *pond.WorkerPool
+	c  *http.Client
+	wg sync.WaitGroup
+
+	lm    sync.Mutex
+	creds CredentialSource
+
+	sm        sync.Mutex
+	paused    map[string]*pendingLogin
+	loggedIn  map[string]time.Time
+	onSession func(SessionEvent)
 
 	fs eridanus.FetcherStorage
-	cs eridanus.ClassesStorage
-	ps eridanus.ParsersStorage
+	ls eridanus.LoginsStorage
 	ds eridanus.ContentStorage
-	ts eridanus.TagStorage
+	ts eridanus.TagStorage // the combined view, adding to the service for each record
+}
+
+// Option configures a Fetcher.
+type Option func(*Fetcher)
+
+// WithTransport sets the RoundTripper used for requests not found in the web cache.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(f *Fetcher) { f.rt = rt }
 }
 
 // NewFetcher returns a new fetcher instance.
-func NewFetcher(s eridanus.Storage) (*Fetcher, error) {
+func NewFetcher(s eridanus.Storage, opts ...Option) (*Fetcher, error) {
+	r, err := eridanus.NewRegistry(s.ClassesStorage(), s.ParsersStorage())
+	if err != nil {
+		return nil, err
+	}
+
 	f := &Fetcher{
 		m: &sync.RWMutex{},
 		s: map[string]*semaphore.Weighted{"": semaphore.NewWeighted(5)},
 
 		rt: http.DefaultTransport,
 		fs: s.FetcherStorage(),
-		cs: s.ClassesStorage(),
-		ps: s.ParsersStorage(),
+		ls: s.LoginsStorage(),
 		ds: s.ContentStorage(),
 		ts: s.TagStorage(),
-		d:  buildClassParserMap(s),
+		r:  r,
 		p: pond.New(maxWorkers, 0,
 			pond.IdleTimeout(1*time.Second),
 			pond.PanicHandler(func(v interface{}) { logrus.Error(v) }),
 			pond.Strategy(pond.Balanced()),
 		),
+		creds:    EnvCredentials,
+		paused:   make(map[string]*pendingLogin),
+		loggedIn: make(map[string]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(f)
 	}
 
 	f.c = &http.Client{
@@ -147,12 +110,17 @@ func NewFetcher(s eridanus.Storage) (*Fetcher, error) {
 
 // Close shuts down the fetcher instance.
 func (f *Fetcher) Close() error {
-	f.m.Lock()
-	defer f.m.Unlock()
+	// f.m is not held, as the remaining requests require it to complete
 	f.p.StopAndWait()
 	return nil
 }
 
+// Wait blocks until all queued requests, and any requests queued while
+// processing them, have completed.
+func (f *Fetcher) Wait() {
+	f.wg.Wait()
+}
+
 // RoundTrip provides a caching RoundTripper.
 func (f *Fetcher) RoundTrip(req *http.Request) (*http.Response, error) {
 	f.m.Lock()
@@ -162,6 +130,7 @@ func (f *Fetcher) RoundTrip(req *http.Request) (*http.Response, error) {
 	if err != nil {
 		logrus.Error(err)
 	} else {
+		resCache.Request = req
 		return resCache, nil
 	}
 
@@ -170,22 +139,27 @@ func (f *Fetcher) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 
 	res, err := f.rt.RoundTrip(req)
-	if err := f.fs.SetCached(res.Request.URL, res); err != nil {
-		logrus.Error(err)
+	if err != nil {
+		return nil, err
+	}
+	// only successful retrievals are cached, leaving redirects and errors to be retried
+	if req.Method == http.MethodGet && res.StatusCode == http.StatusOK {
+		if err := f.fs.SetCached(res.Request.URL, res); err != nil {
+			logrus.Error(err)
+		}
 	}
 
-	return res, err
+	return res, nil
 }
 
 func (f *Fetcher) requestLock(ctx context.Context, u *url.URL) error {
 	f.m.Lock()
-	defer f.m.Unlock()
-
 	if f.s[u.Hostname()] == nil {
 		f.s[u.Hostname()] = semaphore.NewWeighted(1)
 	}
-
 	sLock := f.s[u.Hostname()]
+	f.m.Unlock()
+
 	if err := sLock.Acquire(ctx, 1); err != nil {
 		return err
 	}
@@ -199,28 +173,88 @@ func (f *Fetcher) requestLock(ctx context.Context, u *url.URL) error {
 }
 
 type fbRequest struct {
-	f   *Fetcher
-	req *http.Request
-	res eridanus.ParseResults
-	err error
+	f        *Fetcher
+	req      *http.Request
+	retried  bool                  // a retry after logging in, not carried to its children
+	content  bool                  // found as content on a page, ingested whatever its class
+	pageTags []*eridanus.TagRecord // the tags of the page content was found on
+	res      eridanus.ParseResults
+	err      error
 }
 
 func (r *fbRequest) run() {
 	ctx, cancel := context.WithCancel(r.req.Context())
 	defer cancel()
-	r.f.requestLock(ctx, r.req.URL)
+	log := ctxlogrus.Extract(ctx).WithField("ru", r.req.URL.String())
+
+	req := r.req
+	if au := r.f.apiURL(req.URL); au != nil {
+		req = req.Clone(req.Context())
+		req.URL, req.Host = au, ""
+		log = log.WithField("au", au.String())
+	}
+
+	if err := r.f.awaitSession(ctx, req.URL); err != nil {
+		r.err = err
+		log.Error(err)
+		return
+	}
+	r.f.requestLock(ctx, req.URL)
 
-	res, err := r.f.c.Do(r.req)
+	start := time.Now()
+	res, err := r.f.c.Do(req)
 	if err != nil {
 		r.err = err
+		log.Error(err)
 		return
 	}
 	defer res.Body.Close()
 
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		r.err = err
+		log.Error(err)
+		return
+	}
+
+	if r.f.sessionExpired(ctx, res, body) {
+		if r.retried {
+			r.err = fmt.Errorf("session still expired after logging in: %s", req.URL)
+			log.Error(r.err)
+			return
+		}
+		if err := r.f.fs.DeleteCached(res.Request.URL); err != nil {
+			log.Warn(err)
+		}
+		if err := r.f.relogin(ctx, req.URL, start); err != nil {
+			r.err = err
+			log.Error(err)
+			return
+		}
+		retry := r.req.Clone(r.req.Context())
+		retry.Header.Del("Cookie") // added from the jar by the client, now stale
+		r.f.queue(&fbRequest{f: r.f, req: retry, retried: true, content: r.content, pageTags: r.pageTags})
+		return
+	}
+
+	// api responses are parsed and recorded as the page they were requested for
+	ru := res.Request.URL
+	if req != r.req {
+		ru = r.req.URL
+	}
+
 	contentType := res.Header.Get("Content-Type")
-	if strings.HasPrefix(contentType, "text/html") { // ParseHTML
-		if err := r.f.parse(ctx, r.req, res); err != nil {
+	switch {
+	case strings.HasPrefix(contentType, "text/html") || req != r.req:
+		if err := r.f.parse(ctx, r.req, ru, res, body); err != nil {
+			r.err = err
+			log.Debug(err)
+			return
+		}
+	case r.content || r.f.isFile(ru):
+		if err := r.f.ingest(ctx, ru, body, r.pageTags); err != nil {
 			r.err = err
+			log.Error(err)
 			return
 		}
 	}
@@ -228,25 +262,59 @@ func (r *fbRequest) run() {
 
 // Queue adds a url to be retrieved and processed.
 func (f *Fetcher) Queue(req *http.Request) {
-	f.p.Submit((&fbRequest{f: f, req: req}).run)
+	f.queue(&fbRequest{f: f, req: req})
+}
+
+func (f *Fetcher) queue(r *fbRequest) {
+	f.wg.Add(1)
+	f.p.Submit(func() {
+		defer f.wg.Done()
+		r.run()
+	})
 }
 
 // QueueAndWait adds a url to be retrieved and processed in a synchronous manner.
 func (f *Fetcher) QueueAndWait(req *http.Request) {
-	f.p.SubmitAndWait((&fbRequest{f: f, req: req}).run)
+	f.wg.Add(1)
+	r := &fbRequest{f: f, req: req}
+	f.p.SubmitAndWait(func() {
+		defer f.wg.Done()
+		r.run()
+	})
 }
 
-func (f *Fetcher) parse(ctx context.Context, req *http.Request, res *http.Response) error {
-	log := ctxlogrus.Extract(ctx)
-	log.Info("parsing...")
-	ru := res.Request.URL
+// classify classifies the URL against all stored classes.
+func (f *Fetcher) classify(u *url.URL) (*eridanus.URLClass, *url.URL, eridanus.Tags, error) {
+	return f.r.Classify(u)
+}
+
+// isFile indicates if the URL is classified as a file.
+func (f *Fetcher) isFile(u *url.URL) bool {
+	uc, _, _, err := f.classify(u)
+	return err == nil && uc.GetClass() == eridanus.URLClass_FILE
+}
 
-	classes, err := getAllClasses(f.cs)
+// apiURL returns the URL to fetch in place of u if its class specifies one.
+func (f *Fetcher) apiURL(u *url.URL) *url.URL {
+	uc, _, _, err := f.classify(u)
+	if err != nil || uc.GetApiUrl() == "" {
+		return nil
+	}
+	au, err := eridanus.TransformURL(uc, u, f.r.Synonyms())
 	if err != nil {
-		return err
+		logrus.WithField("uc", uc.GetName()).Warn(err)
+		return nil
 	}
+	return au
+}
 
-	uc, nu, err := eridanus.Classify(ru, classes)
+// parse applies the parsers for ru's class to body, recording the results
+// under ru's normalized form.
+func (f *Fetcher) parse(ctx context.Context, req *http.Request, ru *url.URL, res *http.Response, body []byte) error {
+	log := ctxlogrus.Extract(ctx)
+	log.Info("parsing...")
+
+	uc, nu, urlTags, err := f.classify(ru)
 	if err != nil {
 		return err
 	}
@@ -257,16 +325,16 @@ func (f *Fetcher) parse(ctx context.Context, req *http.Request, res *http.Respon
 		return nil
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
-	}
-
-	var tags []string
+	tags := urlTags.Records(eridanus.TagRecord_URL, "", ru.String())
 	results := &eridanus.ParseResults{Results: []*eridanus.ParseResult{
 		{Type: eridanus.ParseResultType_SOURCE, Value: []string{ru.String()}},
 	}}
-	for _, p := range f.d[uc] {
+	if len(urlTags) > 0 {
+		results.Results = append(results.GetResults(), &eridanus.ParseResult{
+			Type: eridanus.ParseResultType_TAG, Value: urlTags.ToSlice(), Uclass: uc.GetName(),
+		})
+	}
+	for _, p := range f.r.ParsersFor(uc) {
 		log := log.WithField("p", p.GetName())
 		pr := &eridanus.ParseResult{Value: []string{string(body)}}
 
@@ -283,15 +351,19 @@ func (f *Fetcher) parse(ctx context.Context, req *http.Request, res *http.Respon
 
 		switch result.GetType() {
 		case eridanus.ParseResultType_TAG:
-			tags = append(tags, result.GetValue()...)
+			for _, value := range result.GetValue() {
+				tags = append(tags, &eridanus.TagRecord{
+					Tag: value, Source: eridanus.TagRecord_PARSER, Parser: p.GetName(), Url: ru.String(),
+				})
+			}
 		case eridanus.ParseResultType_CONTENT, eridanus.ParseResultType_NEXT, eridanus.ParseResultType_FOLLOW:
 			for i, value := range result.GetValue() {
-				nu, err := ru.Parse(value)
+				vu, err := res.Request.URL.Parse(value)
 				if err != nil {
 					log.Error(err)
 					continue
 				}
-				result.Value[i] = nu.String()
+				result.Value[i] = vu.String()
 			}
 		}
 
@@ -299,7 +371,7 @@ func (f *Fetcher) parse(ctx context.Context, req *http.Request, res *http.Respon
 	}
 
 	// persist results
-	if err := f.fs.SetResults(ru, results); err != nil {
+	if err := f.fs.SetResults(nu, results); err != nil {
 		return err
 	}
 
@@ -307,18 +379,43 @@ func (f *Fetcher) parse(ctx context.Context, req *http.Request, res *http.Respon
 		switch result.GetType() {
 		case eridanus.ParseResultType_CONTENT, eridanus.ParseResultType_NEXT, eridanus.ParseResultType_FOLLOW:
 			for _, value := range result.GetValue() {
-				req, err := http.NewRequestWithContext(ctx, http.MethodGet, value, nil)
+				req, err := http.NewRequestWithContext(req.Context(), http.MethodGet, value, nil)
 				if err != nil {
 					log.Error(err)
 					continue
 				}
-				f.Queue(req)
+				r := &fbRequest{f: f, req: req}
+				if result.GetType() == eridanus.ParseResultType_CONTENT {
+					// content is tagged with what was found on the page
+					r.content, r.pageTags = true, tags
+				}
+				f.queue(r)
 			}
 		}
 	}
 	return nil
 }
 
+// ingest stores content, tagging it with its source, any tags derived from its
+// url, and pageTags, those of the page it was found on.
+func (f *Fetcher) ingest(ctx context.Context, ru *url.URL, body []byte, pageTags []*eridanus.TagRecord) error {
+	idHash, err := f.ds.Put(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	log := ctxlogrus.Extract(ctx).WithField("h", idHash)
+	log.Info("ingesting...")
+
+	tags := append([]*eridanus.TagRecord(nil), pageTags...)
+	if _, _, urlTags, err := f.classify(ru); err == nil {
+		tags = append(tags, urlTags.Records(eridanus.TagRecord_URL, "", ru.String())...)
+	}
+	tags = append(tags, &eridanus.TagRecord{
+		Tag: eridanus.NewTag(eridanus.NamespaceSource, ru.String()).String(), Source: eridanus.TagRecord_URL, Url: ru.String(),
+	})
+	return f.ts.Add(idHash, tags...)
+}
+
 func (f *Fetcher) parseResponse(fbCtx *fetchbot.Context, res *http.Response, err error) {
 	log := logrus.WithField("ru", res.Request.URL.String())
 	if err != nil {
@@ -329,13 +426,7 @@ func (f *Fetcher) parseResponse(fbCtx *fetchbot.Context, res *http.Response, err
 	log.Info("parsing...")
 	ru := res.Request.URL
 
-	classes, err := getAllClasses(f.cs)
-	if err != nil {
-		log.Debug(err)
-		return
-	}
-
-	uc, nu, err := eridanus.Classify(ru, classes)
+	uc, nu, _, err := f.classify(ru)
 	if err != nil {
 		log.Debug(err)
 		return
@@ -357,7 +448,7 @@ func (f *Fetcher) parseResponse(fbCtx *fetchbot.Context, res *http.Response, err
 	results := &eridanus.ParseResults{Results: []*eridanus.ParseResult{
 		{Type: eridanus.ParseResultType_SOURCE, Value: []string{ru.String()}},
 	}}
-	for _, p := range f.d[uc] {
+	for _, p := range f.r.ParsersFor(uc) {
 		log := log.WithField("p", p.GetName())
 		pr := &eridanus.ParseResult{Value: []string{string(body)}}
 
@@ -420,13 +511,7 @@ func (f *Fetcher) handleResponse(fbCtx *fetchbot.Context, res *http.Response, er
 	log.Info("handling...")
 	ru := res.Request.URL
 
-	classes, err := getAllClasses(f.cs)
-	if err != nil {
-		log.Debug(err)
-		return
-	}
-
-	uc, nu, err := eridanus.Classify(ru, classes)
+	uc, nu, _, err := f.classify(ru)
 	if err != nil {
 		log.WithError(err).Infof("no class: %s", ru)
 	}
@@ -446,15 +531,10 @@ func (f *Fetcher) handleResponse(fbCtx *fetchbot.Context, res *http.Response, er
 	}
 	log = logrus.WithField("h", idHash)
 
-	tags, err := f.ts.Get(eridanus.IDHash(idHash))
-	if err != nil {
-		log.Error(err)
-		return
+	tag := &eridanus.TagRecord{
+		Tag: eridanus.NewTag(eridanus.NamespaceSource, ru.String()).String(), Source: eridanus.TagRecord_URL, Url: ru.String(),
 	}
-
-	tags = append(tags, eridanus.Tag(fmt.Sprintf("source:%s", ru)))
-
-	if err := f.ts.Put(eridanus.IDHash(idHash), tags); err != nil {
+	if err := f.ts.Add(eridanus.IDHash(idHash), tag); err != nil {
 		log.Error(err)
 		return
 	}
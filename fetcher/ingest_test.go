@@ -0,0 +1,126 @@
+package fetcher
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+)
+
+func TestIngest_Tags(t *testing.T) {
+	content := []byte("not really a png")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pictures/user/Calm/801362/Patreon-70", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><img src="/img/801362.png"><a rel="tag">Hat</a></body></html>`)
+	})
+	mux.HandleFunc("/img/801362.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(content)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestStorage(t)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{
+		Name: "test post", Class: eridanus.URLClass_POST, Domain: "127.0.0.1", AllowHttp: true,
+		Path: []*eridanus.StringMatcher{
+			{Value: "pictures"},
+			{Value: "user"},
+			{Type: eridanus.StringMatcher_ALNUMS, TagNamespace: "creator"},
+			{Type: eridanus.StringMatcher_DIGITS, TagNamespace: "post_id"},
+			{Type: eridanus.StringMatcher_ANY},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*eridanus.Parser{
+		{Name: "test content", Type: eridanus.ParseResultType_CONTENT,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//img/@src`}},
+			Urls:       []string{srv.URL + "/pictures/user/Calm/801362/Patreon-70"}},
+		{Name: "test tags", Type: eridanus.ParseResultType_TAG,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@rel="tag"]`}},
+			Urls:       []string{srv.URL + "/pictures/user/Calm/801362/Patreon-70"}},
+	} {
+		if err := s.ParsersStorage().Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crawl(t, s, srv.Client().Transport, srv.URL+"/pictures/user/Calm/801362/Patreon-70")
+
+	idHash, err := eridanus.GenerateIDHash(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.ContentStorage().Has(idHash) {
+		t.Fatalf("content %s not stored", idHash)
+	}
+	tags, err := s.TagStorage().Get(idHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tags.ToSlice()
+	sort.Strings(got)
+	want := []string{"creator:calm", "hat", "post_id:801362", "source:" + srv.URL + "/img/801362.png"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("tags: got %v, want %v", got, want)
+	}
+}
+
+func TestIngest_NextFromContent(t *testing.T) {
+	blob := []byte("not content")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pages/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a class="content" href="/pages/2">two</a><a rel="tag">Hat</a></body></html>`)
+	})
+	mux.HandleFunc("/pages/2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a rel="next" href="/blob">next</a></body></html>`)
+	})
+	mux.HandleFunc("/blob", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(blob)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestStorage(t)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{
+		Name: "test page", Class: eridanus.URLClass_POST, Domain: "127.0.0.1", AllowHttp: true,
+		Path: []*eridanus.StringMatcher{{Value: "pages"}, {Type: eridanus.StringMatcher_DIGITS}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*eridanus.Parser{
+		{Name: "test content", Type: eridanus.ParseResultType_CONTENT,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@class="content"]/@href`}},
+			Urls:       []string{srv.URL + "/pages/1"}},
+		{Name: "test next", Type: eridanus.ParseResultType_NEXT,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@rel="next"]/@href`}},
+			Urls:       []string{srv.URL + "/pages/1"}},
+		{Name: "test tags", Type: eridanus.ParseResultType_TAG,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@rel="tag"]`}},
+			Urls:       []string{srv.URL + "/pages/1"}},
+	} {
+		if err := s.ParsersStorage().Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crawl(t, s, srv.Client().Transport, srv.URL+"/pages/1")
+
+	// the next page of a content result is neither content nor a file
+	idHash, err := eridanus.GenerateIDHash(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ContentStorage().Has(idHash) {
+		t.Errorf("next page %s stored as content", idHash)
+	}
+}
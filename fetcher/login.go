@@ -0,0 +1,178 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/improbable-eng/go-httpwares/logging/logrus/ctxlogrus"
+	"github.com/pkg/errors"
+	"github.com/scytrin/eridanus"
+	"gopkg.in/xmlpath.v2"
+)
+
+var (
+	hiddenInputsPath = xmlpath.MustCompile(`//form//input[@type="hidden"]`)
+	inputNamePath    = xmlpath.MustCompile(`@name`)
+	inputValuePath   = xmlpath.MustCompile(`@value`)
+)
+
+// CredentialSource resolves a credential reference used by a Login.
+type CredentialSource func(ref string) (string, error)
+
+// EnvCredentials resolves references of the form "env:NAME" from the environment.
+func EnvCredentials(ref string) (string, error) {
+	if !strings.HasPrefix(ref, "env:") {
+		return "", errors.Errorf("unsupported credential reference %q", ref)
+	}
+	v, ok := os.LookupEnv(strings.TrimPrefix(ref, "env:"))
+	if !ok {
+		return "", errors.Errorf("credential %q not set", ref)
+	}
+	return v, nil
+}
+
+// WithCredentials sets the CredentialSource used by login scripts.
+func WithCredentials(cs CredentialSource) Option {
+	return func(f *Fetcher) { f.creds = cs }
+}
+
+// isLoginWall indicates if the response landed on a page classified as a login wall.
+func (f *Fetcher) isLoginWall(res *http.Response) bool {
+	uc, _, _, err := f.classify(res.Request.URL)
+	if err != nil {
+		return false
+	}
+	return uc.GetClass() == eridanus.URLClass_LOGIN
+}
+
+// Login runs the login script for the URL's domain, storing the resulting
+// cookies in the FetcherStorage jar.
+func (f *Fetcher) Login(ctx context.Context, u *url.URL) error {
+	l, err := f.ls.For(u)
+	if err != nil {
+		return err
+	}
+
+	f.lm.Lock()
+	defer f.lm.Unlock()
+
+	log := ctxlogrus.Extract(ctx).WithField("login", l.GetName())
+	log.Info("logging in...")
+
+	// requests are made around the web cache
+	c := &http.Client{Transport: f.rt, Jar: f.fs}
+
+	form := url.Values{}
+	if l.GetFormUrl() != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.GetFormUrl(), nil)
+		if err != nil {
+			return err
+		}
+		res, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if node, err := xmlpath.ParseHTML(bytes.NewReader(body)); err == nil {
+			for iter := hiddenInputsPath.Iter(node); iter.Next(); {
+				if name, ok := inputNamePath.String(iter.Node()); ok && name != "" {
+					value, _ := inputValuePath.String(iter.Node())
+					form.Set(name, value)
+				}
+			}
+		}
+	}
+	for k, v := range l.GetFields() {
+		form.Set(k, v)
+	}
+	for k, ref := range l.GetCredentials() {
+		if f.creds == nil {
+			return errors.Errorf("no credential source for %q", ref)
+		}
+		v, err := f.creds(ref)
+		if err != nil {
+			return err
+		}
+		form.Set(k, v)
+	}
+
+	action := l.GetActionUrl()
+	if action == "" {
+		action = l.GetFormUrl()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, action, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("login %q failed: %s", l.GetName(), res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	for i, check := range l.GetSuccess() {
+		ok, err := applyCheck(check, res.Request.URL, body, f.fs)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.Errorf("login %q failed check %d: %v", l.GetName(), i, check)
+		}
+	}
+	log.Info("logged in")
+	return nil
+}
+
+// applyCheck tests a response against a login check.
+func applyCheck(c *eridanus.Login_Check, u *url.URL, body []byte, jar http.CookieJar) (bool, error) {
+	ok, err := matchCheck(c, u, body, jar)
+	if err != nil {
+		return false, err
+	}
+	return ok != c.GetInvert(), nil
+}
+
+func matchCheck(c *eridanus.Login_Check, u *url.URL, body []byte, jar http.CookieJar) (bool, error) {
+	switch c.GetType() {
+	case eridanus.Login_Check_COOKIE:
+		for _, cookie := range jar.Cookies(u) {
+			if cookie.Name == c.GetValue() {
+				return true, nil
+			}
+		}
+		return false, nil
+	case eridanus.Login_Check_XPATH:
+		path, err := xmlpath.Compile(c.GetValue())
+		if err != nil {
+			return false, err
+		}
+		node, err := xmlpath.ParseHTML(bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		return path.Exists(node), nil
+	case eridanus.Login_Check_REGEX:
+		return regexp.Match(c.GetValue(), body)
+	case eridanus.Login_Check_URL:
+		return regexp.MatchString(c.GetValue(), u.String())
+	}
+	return false, errors.Errorf("unknown check type %v", c.GetType())
+}
@@ -0,0 +1,143 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+)
+
+const (
+	testCSRF     = "c5rf"
+	testPassword = "hunter2"
+)
+
+func newTestLoginSite() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if r.FormValue("csrf") != testCSRF || r.FormValue("user") != "calm" || r.FormValue("pass") != testPassword {
+				http.Error(w, "bad login", http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "ok", Path: "/"})
+			http.Redirect(w, r, "/account", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><form method="post">
+			<input type="hidden" name="csrf" value="%s">
+			<input type="text" name="user"><input type="password" name="pass">
+		</form></body></html>`, testCSRF)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a id="logout" href="/logout">logout</a></body></html>`)
+	})
+	mux.HandleFunc("/gallery/", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "ok" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body><a class="post" href="/post/1">one</a></body></html>`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func seedTestLogin(t *testing.T, s eridanus.Storage, base string, success ...*eridanus.Login_Check) {
+	t.Helper()
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{
+		Name: "test login", Class: eridanus.URLClass_LOGIN, Domain: "127.0.0.1", AllowHttp: true,
+		Path: []*eridanus.StringMatcher{{Value: "login"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoginsStorage().Put(&eridanus.Login{
+		Name:        "test",
+		Domain:      "127.0.0.1",
+		FormUrl:     base + "/login",
+		Fields:      map[string]string{"user": "calm"},
+		Credentials: map[string]string{"pass": "env:ERIDANUS_TEST_PASSWORD"},
+		Success:     success,
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	srv := newTestLoginSite()
+	defer srv.Close()
+	os.Setenv("ERIDANUS_TEST_PASSWORD", testPassword)
+	defer os.Unsetenv("ERIDANUS_TEST_PASSWORD")
+
+	s := newTestStorage(t)
+	seedTestDefinitions(t, s, srv.URL)
+	seedTestLogin(t, s, srv.URL,
+		&eridanus.Login_Check{Type: eridanus.Login_Check_COOKIE, Value: "session"},
+		&eridanus.Login_Check{Type: eridanus.Login_Check_XPATH, Value: `//a[@id="logout"]`},
+		&eridanus.Login_Check{Type: eridanus.Login_Check_URL, Value: `/account$`},
+	)
+	crawl(t, s, srv.Client().Transport, srv.URL+"/gallery/a")
+
+	u, err := url.Parse(srv.URL + "/gallery/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := s.FetcherStorage().GetResults(u)
+	if err != nil {
+		t.Fatalf("GetResults(%q): %v", u, err)
+	}
+	var follows []string
+	for _, r := range results.GetResults() {
+		if r.GetType() == eridanus.ParseResultType_FOLLOW {
+			follows = append(follows, r.GetValue()...)
+		}
+	}
+	if want := []string{srv.URL + "/post/1"}; fmt.Sprint(follows) != fmt.Sprint(want) {
+		t.Errorf("follows: got %v, want %v", follows, want)
+	}
+}
+
+func TestLogin_Failure(t *testing.T) {
+	srv := newTestLoginSite()
+	defer srv.Close()
+
+	for i, test := range []struct {
+		creds CredentialSource
+		check *eridanus.Login_Check
+	}{
+		{func(string) (string, error) { return "wrong", nil }, nil},
+		{func(string) (string, error) { return testPassword, nil },
+			&eridanus.Login_Check{Type: eridanus.Login_Check_REGEX, Value: `welcome back`}},
+		{func(string) (string, error) { return testPassword, nil },
+			&eridanus.Login_Check{Type: eridanus.Login_Check_COOKIE, Value: "remember"}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			s := newTestStorage(t)
+			var checks []*eridanus.Login_Check
+			if test.check != nil {
+				checks = append(checks, test.check)
+			}
+			seedTestLogin(t, s, srv.URL, checks...)
+			f, err := NewFetcher(s, WithTransport(srv.Client().Transport), WithCredentials(test.creds))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			u, err := url.Parse(srv.URL + "/gallery/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Login(context.Background(), u); err == nil {
+				t.Error("Login: got nil, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package fetcher
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+)
+
+func TestFetcherReload(t *testing.T) {
+	srv := newTestSite()
+	defer srv.Close()
+
+	s := newTestStorage(t)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{
+		Name: "test post", Class: eridanus.URLClass_POST, Domain: "127.0.0.1", AllowHttp: true,
+		Path: []*eridanus.StringMatcher{{Value: "post"}, {Type: eridanus.StringMatcher_DIGITS}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFetcher(s, WithTransport(srv.Client().Transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tags := func(path string) []string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.QueueAndWait(req)
+		u, err := url.Parse(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := s.FetcherStorage().GetResults(u)
+		if err != nil {
+			t.Fatalf("GetResults(%q): %v", u, err)
+		}
+		var got []string
+		for _, r := range results.GetResults() {
+			if r.GetType() == eridanus.ParseResultType_TAG {
+				got = append(got, r.GetValue()...)
+				if r.GetParserVersion() != 1 {
+					t.Errorf("%s: parser version got %d, want 1", r.GetParser(), r.GetParserVersion())
+				}
+			}
+		}
+		return got
+	}
+
+	if got := tags("/post/1"); len(got) != 0 {
+		t.Errorf("tags before parser added: got %v, want none", got)
+	}
+	if err := s.ParsersStorage().Put(&eridanus.Parser{
+		Name: "test tags", Type: eridanus.ParseResultType_TAG,
+		Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@rel="tag"]`}},
+		Urls:       []string{srv.URL + "/post/1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags("/post/2"), []string{"/post/2"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("tags after parser added: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,90 @@
+package fetcher
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	fstorage "github.com/scytrin/eridanus/storage/fetcher"
+)
+
+// ReplayTransport is an http.RoundTripper serving recorded request/response
+// pairs from a directory, allowing the fetcher to run without network access.
+//
+// Fixtures use the same format and naming as the web cache, so the contents
+// of a web_cache or fixtures namespace may be replayed directly.
+type ReplayTransport struct {
+	// Dir holds the recorded fixtures.
+	Dir string
+	// Record, if true, passes requests without a fixture on to Transport and
+	// records the responses into Dir.
+	Record bool
+	// Transport is used in record mode, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+}
+
+// NewReplayTransport provides a ReplayTransport serving fixtures from dir.
+func NewReplayTransport(dir string) *ReplayTransport {
+	return &ReplayTransport{Dir: dir}
+}
+
+// NewRecordTransport provides a ReplayTransport recording responses from rt into dir.
+func NewRecordTransport(dir string, rt http.RoundTripper) *ReplayTransport {
+	return &ReplayTransport{Dir: dir, Record: true, Transport: rt}
+}
+
+// FixturePath returns the location of the fixture for the provided request.
+func (t *ReplayTransport) FixturePath(req *http.Request) string {
+	key := req.URL.String()
+	if req.Method != "" && req.Method != http.MethodGet {
+		key = req.Method + " " + key
+	}
+	return filepath.Join(t.Dir, fmt.Sprintf("%x", md5.Sum([]byte(key))))
+}
+
+// RoundTrip serves the recorded response for req, recording it first if needed.
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fPath := t.FixturePath(req)
+
+	r, err := os.Open(fPath)
+	if err == nil {
+		defer r.Close()
+		res, err := fstorage.ReadCached(r)
+		if err != nil {
+			return nil, err
+		}
+		res.Request = req
+		return res, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !t.Record {
+		return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL)
+	}
+
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := fstorage.WriteCached(buf, res); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(t.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fPath, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
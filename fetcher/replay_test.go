@@ -0,0 +1,153 @@
+package fetcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage"
+	"github.com/scytrin/eridanus/storage/backend/diskv"
+)
+
+func newTestStorage(t *testing.T) eridanus.Storage {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	be := diskv.NewBackend(dir)
+	t.Cleanup(func() { be.Close() })
+	return storage.NewStorage(be)
+}
+
+func newTestSite() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gallery/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><body>
+			<a class="post" href="/post/1">one</a>
+			<a class="post" href="/post/2">two</a>
+		</body></html>`)
+	})
+	mux.HandleFunc("/post/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<html><body><a rel="tag">%s</a></body></html>`, r.URL.Path)
+	})
+	return httptest.NewServer(mux)
+}
+
+func seedTestDefinitions(t *testing.T, s eridanus.Storage, base string) {
+	t.Helper()
+	for _, uc := range []*eridanus.URLClass{
+		{Name: "test gallery", Class: eridanus.URLClass_LIST, Domain: "127.0.0.1", AllowHttp: true,
+			Path: []*eridanus.StringMatcher{{Value: "gallery"}, {Type: eridanus.StringMatcher_ANY}}},
+		{Name: "test post", Class: eridanus.URLClass_POST, Domain: "127.0.0.1", AllowHttp: true,
+			Path: []*eridanus.StringMatcher{{Value: "post"}, {Type: eridanus.StringMatcher_DIGITS}}},
+	} {
+		if err := s.ClassesStorage().Put(uc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []*eridanus.Parser{
+		{Name: "test follow", Type: eridanus.ParseResultType_FOLLOW,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@class="post"]/@href`}},
+			Urls:       []string{base + "/gallery/a"}},
+		{Name: "test tags", Type: eridanus.ParseResultType_TAG,
+			Operations: []*eridanus.Parser_Operation{{Type: eridanus.Parser_Operation_XPATH, Value: `//a[@rel="tag"]`}},
+			Urls:       []string{base + "/post/1"}},
+	} {
+		if err := s.ParsersStorage().Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func crawl(t *testing.T, s eridanus.Storage, rt http.RoundTripper, start string) {
+	t.Helper()
+	f, err := NewFetcher(s, WithTransport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	req, err := http.NewRequest(http.MethodGet, start, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Queue(req)
+	f.Wait()
+}
+
+func TestReplayTransport(t *testing.T) {
+	srv := newTestSite()
+	base := srv.URL
+	fixtures, err := ioutil.TempDir("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fixtures)
+
+	recorded := newTestStorage(t)
+	seedTestDefinitions(t, recorded, base)
+	crawl(t, recorded, NewRecordTransport(fixtures, srv.Client().Transport), base+"/gallery/a")
+	srv.Close()
+
+	files, err := filepath.Glob(filepath.Join(fixtures, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("recorded fixtures: got %d, want 3", len(files))
+	}
+
+	replayed := newTestStorage(t)
+	seedTestDefinitions(t, replayed, base)
+	crawl(t, replayed, NewReplayTransport(fixtures), base+"/gallery/a")
+
+	for i, test := range []struct {
+		u     string
+		pType eridanus.ParseResultType
+		want  []string
+	}{
+		{base + "/gallery/a", eridanus.ParseResultType_FOLLOW, []string{base + "/post/1", base + "/post/2"}},
+		{base + "/post/1", eridanus.ParseResultType_TAG, []string{"/post/1"}},
+		{base + "/post/2", eridanus.ParseResultType_TAG, []string{"/post/2"}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			u, err := url.Parse(test.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := replayed.FetcherStorage().GetResults(u)
+			if err != nil {
+				t.Fatalf("GetResults(%q): %v", u, err)
+			}
+			var got []string
+			for _, r := range results.GetResults() {
+				if r.GetType() == test.pType {
+					got = append(got, r.GetValue()...)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("results: got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplayTransport_Missing(t *testing.T) {
+	rt := NewReplayTransport(os.TempDir())
+	req, err := http.NewRequest(http.MethodGet, "http://example.invalid/missing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Error("RoundTrip: got nil, want error")
+	}
+}
@@ -0,0 +1,118 @@
+package fetcher
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/improbable-eng/go-httpwares/logging/logrus/ctxlogrus"
+)
+
+// SessionEvent reports an expired login session and the outcome of logging in again.
+type SessionEvent struct {
+	Domain string
+	URL    *url.URL
+	Err    error // nil if the login succeeded
+}
+
+// WithSessionHandler sets a function to be notified when a domain's session expires.
+func WithSessionHandler(h func(SessionEvent)) Option {
+	return func(f *Fetcher) { f.onSession = h }
+}
+
+// sessionExpired indicates if the response shows the domain's session is not logged in,
+// either by landing on a login wall or failing the domain's logged in checks.
+func (f *Fetcher) sessionExpired(ctx context.Context, res *http.Response, body []byte) bool {
+	if f.isLoginWall(res) {
+		return true
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return false
+	}
+	l, err := f.ls.For(res.Request.URL)
+	if err != nil {
+		return false
+	}
+	for _, check := range l.GetLoggedIn() {
+		ok, err := applyCheck(check, res.Request.URL, body, f.fs)
+		if err != nil {
+			ctxlogrus.Extract(ctx).Warn(err)
+			continue
+		}
+		if !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingLogin is a login in progress, its error set before done is closed.
+type pendingLogin struct {
+	done chan struct{}
+	err  error
+}
+
+// awaitSession blocks while the URL's domain is paused for logging in.
+func (f *Fetcher) awaitSession(ctx context.Context, u *url.URL) error {
+	host := u.Hostname()
+	f.sm.Lock()
+	var waits []chan struct{}
+	for domain, p := range f.paused {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			waits = append(waits, p.done)
+		}
+	}
+	f.sm.Unlock()
+
+	for _, ch := range waits {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// relogin pauses requests to the URL's login domain and logs in again, unless
+// a login has completed since the expired request was made. Callers arriving
+// while a login is in progress wait for it and share its error.
+func (f *Fetcher) relogin(ctx context.Context, u *url.URL, since time.Time) error {
+	l, err := f.ls.For(u)
+	if err != nil {
+		return err
+	}
+	domain := l.GetDomain()
+
+	f.sm.Lock()
+	if f.loggedIn[domain].After(since) {
+		f.sm.Unlock()
+		return nil
+	}
+	if p, ok := f.paused[domain]; ok { // already logging in
+		f.sm.Unlock()
+		<-p.done
+		return p.err
+	}
+	p := &pendingLogin{done: make(chan struct{})}
+	f.paused[domain] = p
+	f.sm.Unlock()
+
+	err = f.Login(ctx, u)
+
+	f.sm.Lock()
+	if err == nil {
+		f.loggedIn[domain] = time.Now()
+	}
+	p.err = err
+	delete(f.paused, domain)
+	close(p.done)
+	f.sm.Unlock()
+
+	if f.onSession != nil {
+		f.onSession(SessionEvent{Domain: domain, URL: u, Err: err})
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/scytrin/eridanus"
+)
+
+// expiringSite issues a new session on every login, and can revoke it.
+type expiringSite struct {
+	m       sync.Mutex
+	session int
+	logins  int
+}
+
+func (s *expiringSite) revoke() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.session = -1
+}
+
+func (s *expiringSite) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><form method="post"></form></body></html>`)
+			return
+		}
+		if r.FormValue("pass") != testPassword {
+			http.Error(w, "bad login", http.StatusForbidden)
+			return
+		}
+		s.m.Lock()
+		s.logins++
+		s.session = s.logins
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: fmt.Sprint(s.session), Path: "/"})
+		s.m.Unlock()
+	})
+	mux.HandleFunc("/gallery/", s.page(`<a class="post" href="/post/1">one</a>`))
+	mux.HandleFunc("/post/", s.page(`<a rel="tag">hat</a>`))
+	return mux
+}
+
+// page serves body to a current session, and a login link otherwise.
+func (s *expiringSite) page(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		s.m.Lock()
+		defer s.m.Unlock()
+		if c, err := r.Cookie("session"); err != nil || c.Value != fmt.Sprint(s.session) {
+			fmt.Fprint(w, `<html><body><a id="login" href="/login">please log in</a></body></html>`)
+			return
+		}
+		fmt.Fprintf(w, `<html><body><a id="logout">logout</a>%s</body></html>`, body)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	for i, test := range []struct {
+		password string
+		follows  []string
+		logins   int
+		failed   bool
+	}{
+		{testPassword, []string{"/post/1"}, 2, false},
+		{"wrong", nil, 1, true},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			site := &expiringSite{}
+			srv := httptest.NewServer(site.handler())
+			defer srv.Close()
+
+			s := newTestStorage(t)
+			seedTestDefinitions(t, s, srv.URL)
+			if err := s.LoginsStorage().Put(&eridanus.Login{
+				Name:        "test",
+				Domain:      "127.0.0.1",
+				FormUrl:     srv.URL + "/login",
+				Credentials: map[string]string{"pass": "test"},
+				LoggedIn: []*eridanus.Login_Check{
+					{Type: eridanus.Login_Check_XPATH, Value: `//a[@id="logout"]`},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			var events []SessionEvent
+			password := testPassword
+			f, err := NewFetcher(s,
+				WithTransport(srv.Client().Transport),
+				WithCredentials(func(string) (string, error) { return password, nil }),
+				WithSessionHandler(func(e SessionEvent) { events = append(events, e) }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			u, err := url.Parse(srv.URL + "/gallery/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Login(context.Background(), u); err != nil {
+				t.Fatal(err)
+			}
+			site.revoke()
+			password = test.password
+
+			req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Queue(req)
+			f.Wait()
+
+			if site.logins != test.logins {
+				t.Errorf("logins: got %d, want %d", site.logins, test.logins)
+			}
+			if len(events) != 1 {
+				t.Fatalf("events: got %d, want 1", len(events))
+			}
+			if (events[0].Err != nil) != test.failed {
+				t.Errorf("events[0].Err: got %v, want failure %v", events[0].Err, test.failed)
+			}
+
+			var follows []string
+			if results, err := s.FetcherStorage().GetResults(u); err == nil {
+				for _, r := range results.GetResults() {
+					if r.GetType() == eridanus.ParseResultType_FOLLOW {
+						follows = append(follows, r.GetValue()...)
+					}
+				}
+			}
+			var want []string
+			for _, p := range test.follows {
+				want = append(want, srv.URL+p)
+			}
+			if fmt.Sprint(follows) != fmt.Sprint(want) {
+				t.Errorf("follows: got %v, want %v", follows, want)
+			}
+		})
+	}
+}
+
+func TestSessionExpiryInChild(t *testing.T) {
+	site := &expiringSite{}
+	var once sync.Once
+	mux := http.NewServeMux()
+	mux.Handle("/", site.handler())
+	mux.HandleFunc("/post/", func(w http.ResponseWriter, r *http.Request) {
+		once.Do(site.revoke) // expires again after the gallery's re-login
+		site.handler().ServeHTTP(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s := newTestStorage(t)
+	seedTestDefinitions(t, s, srv.URL)
+	if err := s.LoginsStorage().Put(&eridanus.Login{
+		Name:        "test",
+		Domain:      "127.0.0.1",
+		FormUrl:     srv.URL + "/login",
+		Credentials: map[string]string{"pass": "test"},
+		LoggedIn: []*eridanus.Login_Check{
+			{Type: eridanus.Login_Check_XPATH, Value: `//a[@id="logout"]`},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []SessionEvent
+	f, err := NewFetcher(s,
+		WithTransport(srv.Client().Transport),
+		WithCredentials(func(string) (string, error) { return testPassword, nil }),
+		WithSessionHandler(func(e SessionEvent) { events = append(events, e) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	u, err := url.Parse(srv.URL + "/gallery/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Login(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	site.revoke()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Queue(req)
+	f.Wait()
+
+	if site.logins != 3 {
+		t.Errorf("logins: got %d, want 3", site.logins)
+	}
+	for i, e := range events {
+		if e.Err != nil {
+			t.Errorf("events[%d].Err: got %v, want nil", i, e.Err)
+		}
+	}
+
+	p, err := url.Parse(srv.URL + "/post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	if results, err := s.FetcherStorage().GetResults(p); err == nil {
+		for _, r := range results.GetResults() {
+			if r.GetType() == eridanus.ParseResultType_TAG {
+				tags = append(tags, r.GetValue()...)
+			}
+		}
+	}
+	if fmt.Sprint(tags) != "[hat]" {
+		t.Errorf("tags: got %v, want [hat]", tags)
+	}
+}
+
+func TestReloginSharesError(t *testing.T) {
+	site := &expiringSite{}
+	srv := httptest.NewServer(site.handler())
+	defer srv.Close()
+
+	s := newTestStorage(t)
+	seedTestDefinitions(t, s, srv.URL)
+	if err := s.LoginsStorage().Put(&eridanus.Login{
+		Name:        "test",
+		Domain:      "127.0.0.1",
+		FormUrl:     srv.URL + "/login",
+		Credentials: map[string]string{"pass": "test"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	f, err := NewFetcher(s,
+		WithTransport(srv.Client().Transport),
+		WithCredentials(func(string) (string, error) {
+			once.Do(func() {
+				close(started)
+				<-release
+			})
+			return "wrong", nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	u, err := url.Parse(srv.URL + "/gallery/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- f.relogin(context.Background(), u, time.Now()) }()
+	<-started
+	go func() { errs <- f.relogin(context.Background(), u, time.Now()) }()
+	time.Sleep(50 * time.Millisecond) // let the second caller wait on the first
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			t.Errorf("relogin %d: got nil, want the login's error", i)
+		}
+	}
+}
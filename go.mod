@@ -1,6 +1,6 @@
 module github.com/scytrin/eridanus
 
-go 1.13
+go 1.16
 
 require (
 	github.com/PuerkitoBio/fetchbot v1.2.0
@@ -0,0 +1,42 @@
+package eridanus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Implied provides the lowercased tags the tag implies, directly or through
+// others, sorted.
+func (tp *TagParents) Implied(t Tag) Tags {
+	seen := make(map[string]bool)
+	var visit func(string)
+	visit = func(t string) {
+		for _, p := range tp.GetParents()[t].GetTags() {
+			p = strings.ToLower(p)
+			if !seen[p] {
+				seen[p] = true
+				visit(p)
+			}
+		}
+	}
+	visit(strings.ToLower(string(t)))
+	var out Tags
+	for p := range seen {
+		out = append(out, Tag(p))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// Check returns an error if a tag implies itself.
+func (tp *TagParents) Check() error {
+	for child := range tp.GetParents() {
+		for _, p := range tp.Implied(Tag(child)) {
+			if string(p) == child {
+				return fmt.Errorf("parent cycle: %s implies itself", child)
+			}
+		}
+	}
+	return nil
+}
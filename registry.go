@@ -0,0 +1,112 @@
+package eridanus
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Registry holds classes and parsers in memory along with an index of the
+// parsers applicable to each class, reloading when either storage changes.
+type Registry struct {
+	cs ClassesStorage
+	ps ParsersStorage
+
+	m   sync.Mutex   // serializes reloads
+	idx atomic.Value // *registryIndex
+}
+
+type registryIndex struct {
+	synonyms DomainSynonyms
+	classes  []*URLClass // in the order of SortURLClasses
+	parsers  []*Parser
+	byClass  map[string][]*Parser
+}
+
+// NewRegistry loads the classes and parsers of the provided storages.
+func NewRegistry(cs ClassesStorage, ps ParsersStorage) (*Registry, error) {
+	r := &Registry{cs: cs, ps: ps}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	reload := func() {
+		if err := r.Reload(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	cs.OnChange(reload)
+	ps.OnChange(reload)
+	return r, nil
+}
+
+// Reload reads the domain synonyms, classes and parsers, replacing those held
+// only if all are read successfully.
+func (r *Registry) Reload() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	synonyms, err := r.cs.DomainSynonyms()
+	if err != nil {
+		return err
+	}
+	classes, err := r.cs.GetAll()
+	if err != nil {
+		return err
+	}
+	classes = append([]*URLClass(nil), classes...)
+	SortURLClasses(classes)
+	parsers, err := r.ps.GetAll()
+	if err != nil {
+		return err
+	}
+
+	byClass := make(map[string][]*Parser)
+	for _, uc := range classes {
+		for _, p := range parsers {
+			for _, su := range p.GetUrls() {
+				u, err := url.Parse(su)
+				if err != nil {
+					continue
+				}
+				if _, err := ApplyClassifier(uc, u, synonyms); err == nil {
+					byClass[uc.GetName()] = append(byClass[uc.GetName()], p)
+					break
+				}
+			}
+		}
+	}
+	r.idx.Store(&registryIndex{synonyms: synonyms, classes: classes, parsers: parsers, byClass: byClass})
+	return nil
+}
+
+func (r *Registry) index() *registryIndex {
+	return r.idx.Load().(*registryIndex)
+}
+
+// Classes returns all classes, in the order of SortURLClasses.
+func (r *Registry) Classes() []*URLClass {
+	return append([]*URLClass(nil), r.index().classes...)
+}
+
+// Synonyms returns the domain synonym table, which is not to be modified.
+func (r *Registry) Synonyms() DomainSynonyms {
+	return r.index().synonyms
+}
+
+// Parsers returns all parsers.
+func (r *Registry) Parsers() []*Parser {
+	return append([]*Parser(nil), r.index().parsers...)
+}
+
+// ParsersFor returns the parsers with an example URL matching the class.
+func (r *Registry) ParsersFor(uc *URLClass) []*Parser {
+	return r.index().byClass[uc.GetName()]
+}
+
+// Classify classifies the URL against all classes, as Classify.
+func (r *Registry) Classify(u *url.URL) (*URLClass, *url.URL, Tags, error) {
+	idx := r.index()
+	return Classify(u, idx.classes, idx.synonyms)
+}
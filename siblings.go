@@ -0,0 +1,69 @@
+package eridanus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Canonical provides the tag the tag's aliases lead to, or the tag itself if
+// it is not an alias.
+func (ts *TagSiblings) Canonical(t Tag) Tag {
+	seen := make(map[string]bool)
+	for {
+		key := strings.ToLower(string(t))
+		c, ok := ts.GetSiblings()[key]
+		if !ok || seen[key] {
+			return t
+		}
+		seen[key] = true
+		t = Tag(c)
+	}
+}
+
+// Canonicalize replaces aliases by their canonical tags.
+func (ts *TagSiblings) Canonicalize(tags Tags) Tags {
+	if len(ts.GetSiblings()) == 0 {
+		return tags
+	}
+	out := make(Tags, len(tags))
+	for i, t := range tags {
+		out[i] = ts.Canonical(t)
+	}
+	return out.OmitDuplicates()
+}
+
+// Group provides the lowercased canonical tag of the tag and all the aliases
+// leading to it, sorted.
+func (ts *TagSiblings) Group(t Tag) Tags {
+	c := strings.ToLower(string(ts.Canonical(t)))
+	group := Tags{Tag(c)}
+	for alias := range ts.GetSiblings() {
+		if alias != c && strings.ToLower(string(ts.Canonical(Tag(alias)))) == c {
+			group = append(group, Tag(alias))
+		}
+	}
+	sort.Slice(group, func(i, j int) bool { return group[i] < group[j] })
+	return group
+}
+
+// Check returns an error if an alias leads back to itself.
+func (ts *TagSiblings) Check() error {
+	for alias := range ts.GetSiblings() {
+		path := []string{alias}
+		seen := map[string]bool{alias: true}
+		for t := alias; ; {
+			c, ok := ts.GetSiblings()[t]
+			if !ok {
+				break
+			}
+			t = strings.ToLower(c)
+			path = append(path, c)
+			if seen[t] {
+				return fmt.Errorf("sibling cycle: %s", strings.Join(path, " -> "))
+			}
+			seen[t] = true
+		}
+	}
+	return nil
+}
@@ -1,11 +1,9 @@
 package similar
 
 import (
-	"fmt"
 	"image"
 	"io"
 	"math"
-	"strings"
 	"time"
 
 	"github.com/corona10/goimagehash"
@@ -41,8 +39,14 @@ func buildHash(ts eridanus.TagStorage, cs eridanus.ContentStorage, idHash eridan
 			return nil, err
 		}
 
-		tags = append(tags, eridanus.Tag(fmt.Sprintf("phash:%s", pHash.ToString())))
-		if err := ts.Put(idHash, tags); err != nil {
+		tag := &eridanus.TagRecord{
+			Tag: eridanus.NewTag(eridanus.NamespacePHash, pHash.ToString()).String(), Source: eridanus.TagRecord_CONTENT,
+		}
+		sts, err := ts.Service(eridanus.ServiceSystem)
+		if err != nil {
+			return nil, err
+		}
+		if err := sts.Add(idHash, tag); err != nil {
 			return nil, err
 		}
 	}
@@ -79,19 +83,18 @@ func buildVPTree(hashes []vptree.Comparable, effort int) (*vptree.Tree, error) {
 }
 
 func extractPHashTag(tags eridanus.Tags) (*goimagehash.ImageHash, error) {
-	for _, tag := range tags {
-		if strings.HasPrefix(string(tag), "phash:") {
-			pHash, err := goimagehash.ImageHashFromString(strings.TrimPrefix(string(tag), "phash:"))
-			if err != nil {
-				return nil, err
-			}
-			if pHash.GetKind() != goimagehash.PHash {
-				return nil, errors.Errorf("phash type mismatch: %v", pHash.GetKind())
-			}
-			return pHash, nil
-		}
+	pHashTags := tags.ByNamespace(eridanus.NamespacePHash)
+	if len(pHashTags) == 0 {
+		return nil, errors.New("no phash tag found")
 	}
-	return nil, errors.New("no phash tag found")
+	pHash, err := goimagehash.ImageHashFromString(pHashTags[0].Subtag())
+	if err != nil {
+		return nil, err
+	}
+	if pHash.GetKind() != goimagehash.PHash {
+		return nil, errors.Errorf("phash type mismatch: %v", pHash.GetKind())
+	}
+	return pHash, nil
 }
 
 func generatePHashTag(r io.Reader) (i *goimagehash.ImageHash, err error) {
@@ -0,0 +1,223 @@
+// Package bundles imports and exports shareable sets of class and parser
+// definitions.
+package bundles
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
+)
+
+// Conflict specifies how ImportBundle treats definitions whose names are in use.
+type Conflict int
+
+// The ways to resolve a conflicting name.
+const (
+	Skip      Conflict = iota // keep the stored definition
+	Overwrite                 // replace the stored definition
+	Rename                    // store the bundled definition under an unused name
+)
+
+// ParseConflict returns the Conflict named skip, overwrite or rename.
+func ParseConflict(s string) (Conflict, error) {
+	switch s {
+	case "skip", "":
+		return Skip, nil
+	case "overwrite":
+		return Overwrite, nil
+	case "rename":
+		return Rename, nil
+	}
+	return Skip, fmt.Errorf("unknown conflict mode %q", s)
+}
+
+// ImportReport maps the name of each bundled definition to the name it was
+// stored under, or to an empty string if it was skipped.
+type ImportReport struct {
+	Classes map[string]string `json:"classes"`
+	Parsers map[string]string `json:"parsers"`
+}
+
+// Read decodes a YAML bundle.
+func Read(r io.Reader) (*eridanus.Bundle, error) {
+	var b eridanus.Bundle
+	if err := yaml.NewDecoder(r).Decode(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Write encodes a bundle as YAML.
+func Write(w io.Writer, b *eridanus.Bundle) error {
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(b); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// ExportBundle bundles the named classes with the parsers applicable to them,
+// and cached responses, or else fixtures, for their example URLs as fixtures.
+func ExportBundle(s eridanus.Storage, name string, classNames ...string) (*eridanus.Bundle, error) {
+	b := &eridanus.Bundle{Name: name, Created: time.Now().UTC().Format(time.RFC3339)}
+	examples := make(map[string]bool)
+	synonyms, err := s.ClassesStorage().DomainSynonyms()
+	if err != nil {
+		return nil, err
+	}
+
+	parsers := make(map[string]*eridanus.Parser)
+	for _, cn := range classNames {
+		uc, err := s.ClassesStorage().Get(cn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "class %q", cn)
+		}
+		uc.Version = 0
+		b.Classes = append(b.Classes, uc)
+		for _, e := range uc.GetExamples() {
+			examples[e] = true
+		}
+
+		ps, err := s.ParsersStorage().For(uc, synonyms)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ps {
+			parsers[p.GetName()] = p
+		}
+	}
+	for _, p := range parsers {
+		p = proto.Clone(p).(*eridanus.Parser)
+		p.Version = 0
+		b.Parsers = append(b.Parsers, p)
+		for _, u := range p.GetUrls() {
+			examples[u] = true
+		}
+	}
+	sort.Slice(b.Parsers, func(i, j int) bool { return b.Parsers[i].GetName() < b.Parsers[j].GetName() })
+
+	var raws []string
+	for raw := range examples {
+		raws = append(raws, raw)
+	}
+	sort.Strings(raws)
+	for _, raw := range raws {
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		res, err := s.FetcherStorage().GetCached(u)
+		if err != nil {
+			if res, err = s.FetcherStorage().GetFixture(u); err != nil {
+				continue // not fetched
+			}
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		b.Fixtures = append(b.Fixtures, &eridanus.Bundle_Fixture{
+			Url:         raw,
+			ContentType: res.Header.Get("Content-Type"),
+			Body:        string(body),
+		})
+	}
+	return b, nil
+}
+
+// ImportBundle stores the bundle's definitions, resolving names already in
+// use as specified. Fixtures are stored apart from the web cache, for tests
+// and replay only.
+func ImportBundle(s eridanus.Storage, b *eridanus.Bundle, c Conflict) (*ImportReport, error) {
+	for _, uc := range b.GetClasses() {
+		if err := eridanus.ValidateURLClass(eridanus.UpgradeURLClass(uc)); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range b.GetParsers() {
+		if err := eridanus.ValidateName(p.GetName()); err != nil {
+			return nil, err
+		}
+	}
+
+	author := "bundle:" + b.GetName()
+	report := &ImportReport{Classes: make(map[string]string), Parsers: make(map[string]string)}
+	cs := s.ClassesStorage()
+	for _, uc := range b.GetClasses() {
+		name, ok := resolve(uc.GetName(), cs.Has, c)
+		report.Classes[uc.GetName()] = name
+		if !ok {
+			continue
+		}
+		uc = proto.Clone(uc).(*eridanus.URLClass)
+		uc.Name = name
+		if err := cs.PutBy(uc, author); err != nil {
+			return nil, err
+		}
+	}
+	ps := s.ParsersStorage()
+	for _, p := range b.GetParsers() {
+		name, ok := resolve(p.GetName(), ps.Has, c)
+		report.Parsers[p.GetName()] = name
+		if !ok {
+			continue
+		}
+		p = proto.Clone(p).(*eridanus.Parser)
+		p.Name = name
+		if err := ps.PutBy(p, author); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := s.FetcherStorage()
+	for _, fx := range b.GetFixtures() {
+		u, err := url.Parse(fx.GetUrl())
+		if err != nil {
+			return nil, err
+		}
+		res := &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {fx.GetContentType()}},
+			Body:       ioutil.NopCloser(strings.NewReader(fx.GetBody())),
+			Request:    &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}},
+		}
+		if err := fs.SetFixture(u, res); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// resolve returns the name to store a definition under, and false if it
+// should be skipped.
+func resolve(name string, has func(string) bool, c Conflict) (string, bool) {
+	if !has(name) {
+		return name, true
+	}
+	switch c {
+	case Overwrite:
+		return name, true
+	case Rename:
+		for i := 2; ; i++ {
+			if n := fmt.Sprintf("%s (%d)", name, i); !has(n) {
+				return n, true
+			}
+		}
+	}
+	return "", false
+}
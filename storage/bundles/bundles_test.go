@@ -0,0 +1,174 @@
+package bundles
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage"
+	"github.com/scytrin/eridanus/storage/backend/diskv"
+)
+
+func newTestStorage(t *testing.T) eridanus.Storage {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	be := diskv.NewBackend(dir)
+	t.Cleanup(func() { be.Close() })
+	return storage.NewStorage(be)
+}
+
+func TestExportImport(t *testing.T) {
+	src := newTestStorage(t)
+	for _, uc := range []*eridanus.URLClass{
+		{Name: "post", Class: eridanus.URLClass_POST, Domain: "example.com",
+			Path:     []*eridanus.StringMatcher{{Value: "post"}, {Type: eridanus.StringMatcher_DIGITS}},
+			Examples: []string{"https://example.com/post/1"}},
+		{Name: "gallery", Class: eridanus.URLClass_LIST, Domain: "example.com",
+			Path: []*eridanus.StringMatcher{{Value: "gallery"}}},
+	} {
+		if err := src.ClassesStorage().Put(uc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []*eridanus.Parser{
+		{Name: "post tags", Type: eridanus.ParseResultType_TAG, Urls: []string{"https://example.com/post/1"}},
+		{Name: "gallery follow", Type: eridanus.ParseResultType_FOLLOW, Urls: []string{"https://example.com/gallery"}},
+	} {
+		if err := src.ParsersStorage().Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := url.Parse("https://example.com/post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.FetcherStorage().SetCached(u, &http.Response{
+		StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1,
+		Header:  http.Header{"Content-Type": {"text/html"}},
+		Body:    ioutil.NopCloser(strings.NewReader("<html></html>")),
+		Request: &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ExportBundle(src, "example", "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := Write(buf, b); err != nil {
+		t.Fatal(err)
+	}
+	b, err = Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.GetClasses()) != 1 || len(b.GetParsers()) != 1 || b.GetParsers()[0].GetName() != "post tags" {
+		t.Fatalf("bundle: got %v, want post class and post tags parser", b)
+	}
+	if len(b.GetFixtures()) != 1 || b.GetFixtures()[0].GetBody() != "<html></html>" {
+		t.Fatalf("bundle fixtures: got %v, want the cached post", b.GetFixtures())
+	}
+
+	for i, test := range []struct {
+		c       Conflict
+		class   string
+		parsers []string
+	}{
+		{Skip, "", []string{"post tags"}},
+		{Overwrite, "post", []string{"post tags"}},
+		{Rename, "post (2)", []string{"post tags", "post tags (2)"}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			dst := newTestStorage(t)
+			if err := dst.ClassesStorage().Put(&eridanus.URLClass{Name: "post", Domain: "example.net"}); err != nil {
+				t.Fatal(err)
+			}
+			report, err := ImportBundle(dst, b, test.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := report.Classes["post"]; got != test.class {
+				t.Errorf("class stored as %q, want %q", got, test.class)
+			}
+			if test.class != "" {
+				uc, err := dst.ClassesStorage().Get(test.class)
+				if err != nil || uc.GetDomain() != "example.com" {
+					t.Errorf("Get(%q): got %v, %v, want imported class", test.class, uc, err)
+				}
+			}
+			if _, err := dst.FetcherStorage().GetFixture(u); err != nil {
+				t.Errorf("fixture not stored: %v", err)
+			}
+			if _, err := dst.FetcherStorage().GetCached(u); err == nil {
+				t.Error("fixture stored in the web cache")
+			}
+			if test.c == Rename { // a second import renames the parser too
+				if _, err := ImportBundle(dst, b, test.c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			names, err := dst.ParsersStorage().Names()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.parsers) {
+				t.Errorf("parsers: got %v, want %v", names, test.parsers)
+			}
+		})
+	}
+}
+
+func TestSeedDefaults(t *testing.T) {
+	s := newTestStorage(t)
+	if _, err := SeedDefaults(s, Skip); err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := eridanus.DefaultParsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ParsersStorage().GetAll(); err != nil || len(got) != len(defaults) {
+		t.Fatalf("parsers: got %d (%v), want %d", len(got), err, len(defaults))
+	}
+	if got, err := OutdatedDefaults(s); err != nil || len(got) != 0 {
+		t.Fatalf("outdated after seeding: got %v (%v), want none", got, err)
+	}
+
+	p, err := s.ParsersStorage().Get(defaults[0].GetName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Urls = nil
+	if err := s.ParsersStorage().Put(p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := OutdatedDefaults(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name != p.GetName() || got[0].Version != 2 || !strings.Contains(got[0].Diff, "+") {
+		t.Fatalf("outdated after edit: got %+v, want %q at version 2", got, p.GetName())
+	}
+
+	report, err := SeedDefaults(s, Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Parsers[p.GetName()] != p.GetName() {
+		t.Errorf("report: got %v, want %q overwritten", report.Parsers, p.GetName())
+	}
+	if got, err := OutdatedDefaults(s); err != nil || len(got) != 0 {
+		t.Errorf("outdated after overwriting: got %v (%v), want none", got, err)
+	}
+}
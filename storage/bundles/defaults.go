@@ -0,0 +1,114 @@
+package bundles
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/history"
+	"gopkg.in/yaml.v3"
+)
+
+// SeedDefaults stores the built-in definitions, resolving names already in
+// use as specified.
+func SeedDefaults(s eridanus.Storage, c Conflict) (*ImportReport, error) {
+	bs, err := eridanus.DefaultBundles()
+	if err != nil {
+		return nil, err
+	}
+	report := &ImportReport{Classes: make(map[string]string), Parsers: make(map[string]string)}
+	for _, b := range bs {
+		r, err := ImportBundle(s, b, c)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range r.Classes {
+			report.Classes[k] = v
+		}
+		for k, v := range r.Parsers {
+			report.Parsers[k] = v
+		}
+	}
+	return report, nil
+}
+
+// Outdated is a stored definition differing from the built-in one of its name.
+type Outdated struct {
+	Kind    string `json:"kind"` // class or parser
+	Name    string `json:"name"`
+	Bundle  string `json:"bundle"`
+	Version uint64 `json:"version"` // of the stored definition
+	Diff    string `json:"diff"`    // from the stored to the built-in definition
+}
+
+// OutdatedDefaults lists the stored definitions differing from the built-in
+// ones. Built-in definitions not stored are not listed.
+func OutdatedDefaults(s eridanus.Storage) ([]*Outdated, error) {
+	bs, err := eridanus.DefaultBundles()
+	if err != nil {
+		return nil, err
+	}
+	var out []*Outdated
+	for _, b := range bs {
+		for _, uc := range b.GetClasses() {
+			if !s.ClassesStorage().Has(uc.GetName()) {
+				continue
+			}
+			stored, err := s.ClassesStorage().Get(uc.GetName())
+			if err != nil {
+				return nil, err
+			}
+			o, err := outdated("class", b, uc.GetName(), stored, uc, stored.GetVersion())
+			if err != nil {
+				return nil, err
+			}
+			if o != nil {
+				out = append(out, o)
+			}
+		}
+		for _, p := range b.GetParsers() {
+			if !s.ParsersStorage().Has(p.GetName()) {
+				continue
+			}
+			stored, err := s.ParsersStorage().Get(p.GetName())
+			if err != nil {
+				return nil, err
+			}
+			o, err := outdated("parser", b, p.GetName(), stored, p, stored.GetVersion())
+			if err != nil {
+				return nil, err
+			}
+			if o != nil {
+				out = append(out, o)
+			}
+		}
+	}
+	return out, nil
+}
+
+// outdated compares a stored definition to a built-in one, ignoring versions.
+func outdated(kind string, b *eridanus.Bundle, name string, stored, def proto.Message, version uint64) (*Outdated, error) {
+	stored = proto.Clone(stored)
+	switch v := stored.(type) {
+	case *eridanus.URLClass:
+		v.Version = 0
+	case *eridanus.Parser:
+		v.Version = 0
+	}
+	if proto.Equal(stored, def) {
+		return nil, nil
+	}
+	sy, err := yaml.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	dy, err := yaml.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	return &Outdated{
+		Kind:    kind,
+		Name:    name,
+		Bundle:  b.GetName(),
+		Version: version,
+		Diff:    history.Diff(string(sy), string(dy)),
+	}, nil
+}
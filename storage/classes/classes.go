@@ -4,22 +4,34 @@ import (
 	"bytes"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 
-	"github.com/pkg/errors"
 	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/history"
 	"gopkg.in/yaml.v3"
 )
 
 const (
 	classesNamespace = "classes"
+	synonymsKey      = "synonyms/domains"
 )
 
-type classStorage struct{ be eridanus.StorageBackend }
+type classStorage struct {
+	be eridanus.StorageBackend
+	h  *history.History
+	w  sync.Mutex // serializes changes to stored classes
+
+	m        sync.Mutex
+	all      []*eridanus.URLClass    // cached GetAll result, nil until read
+	synonyms eridanus.DomainSynonyms // cached DomainSynonyms result, nil until read
+	hooks    []func()
+}
 
 // NewClassesStorage provides a new ClassesStorage.
 func NewClassesStorage(be eridanus.StorageBackend) eridanus.ClassesStorage {
-	return &classStorage{be}
+	return &classStorage{be: be, h: history.NewHistory(be, classesNamespace)}
 }
 
 // Names returns a list of all class names.
@@ -34,14 +46,236 @@ func (s *classStorage) Names() ([]string, error) {
 	return keys, nil
 }
 
-// Put adds a classifier.
+// Put adds a classifier, if it is valid.
 func (s *classStorage) Put(c *eridanus.URLClass) error {
+	return s.PutBy(c, "")
+}
+
+// PutBy adds a classifier, if it is valid, recording it as a new version by
+// author. Legacy regex aliases are stored as their typed matchers.
+func (s *classStorage) PutBy(c *eridanus.URLClass, author string) error {
+	s.w.Lock()
+	err := s.put(c, author)
+	s.w.Unlock()
+	if err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// put stores the class as a new version by author. It must be called with s.w
+// held.
+func (s *classStorage) put(c *eridanus.URLClass, author string) error {
+	c = eridanus.UpgradeURLClass(c)
+	if err := eridanus.ValidateURLClass(c); err != nil {
+		return err
+	}
+	c.Version = 0
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	version, added, err := s.h.Record(c.GetName(), author, data)
+	if err != nil {
+		return err
+	}
+	c.Version = version
+
 	cPath := fmt.Sprintf("%s/%s", classesNamespace, c.GetName())
 	buf := bytes.NewBuffer(nil)
-	if err := yaml.NewEncoder(buf).Encode(c); err != nil {
+	err = yaml.NewEncoder(buf).Encode(c)
+	if err == nil {
+		err = s.be.Set(cPath, buf)
+	}
+	if err != nil && added { // leave no version of what was not stored
+		return undone(err, s.h.Forget(c.GetName(), version))
+	}
+	return err
+}
+
+// Versions returns the recorded versions of the named class, oldest first.
+func (s *classStorage) Versions(name string) ([]*eridanus.Revision, error) {
+	return s.h.Versions(name)
+}
+
+// Diff returns the differences between two versions of the named class.
+func (s *classStorage) Diff(name string, a, b uint64) (string, error) {
+	return s.h.Diff(name, a, b)
+}
+
+// Rollback restores a prior version of the named class as a new version by author.
+func (s *classStorage) Rollback(name string, version uint64, author string) error {
+	data, err := s.h.Data(name, version)
+	if err != nil {
+		return err
+	}
+	var v eridanus.URLClass
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v.Name = name // the version may predate a rename
+	return s.PutBy(&v, author)
+}
+
+// Delete removes the named class.
+func (s *classStorage) Delete(name string) error {
+	s.w.Lock()
+	err := s.delete(name)
+	s.w.Unlock()
+	if err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// stored returns an error unless the named class is stored. The name is not
+// validated, so that classes stored under names since made invalid can still
+// be renamed or removed.
+func (s *classStorage) stored(name string) error {
+	names, err := s.Names()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("class %q: %w", name, os.ErrNotExist)
+}
+
+// delete removes the named class. It must be called with s.w held.
+func (s *classStorage) delete(name string) error {
+	if err := s.stored(name); err != nil {
+		return err
+	}
+	return s.be.Delete(fmt.Sprintf("%s/%s", classesNamespace, name))
+}
+
+// Rename renames a class, failing if the new name is in use.
+func (s *classStorage) Rename(from, to string) error {
+	if err := eridanus.ValidateName(to); err != nil {
+		return err
+	}
+	s.w.Lock()
+	err := s.rename(from, to)
+	s.w.Unlock()
+	if err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// rename stores the class and its history under the new name then removes the
+// old, undoing the move if the old could not be. It must be called with s.w
+// held.
+func (s *classStorage) rename(from, to string) error {
+	if s.Has(to) {
+		return fmt.Errorf("class %q already exists", to)
+	}
+	if err := s.stored(from); err != nil {
+		return err
+	}
+	v, err := s.Get(from)
+	if err != nil {
+		return err
+	}
+	v.Name = to
+	if err := s.h.Move(from, to); err != nil {
+		return err
+	}
+	if err := s.put(v, ""); err != nil {
+		return undone(err, s.h.Move(to, from))
+	}
+	if err := s.delete(from); err != nil {
+		return undone(err, s.be.Delete(fmt.Sprintf("%s/%s", classesNamespace, to)), s.h.Move(to, from))
+	}
+	return nil
+}
+
+// undone returns err, noting any errors from undoing the changes before it.
+func undone(err error, undos ...error) error {
+	for _, uerr := range undos {
+		if uerr != nil {
+			err = fmt.Errorf("%v, and undoing: %v", err, uerr)
+		}
+	}
+	return err
+}
+
+// DomainSynonyms returns the stored domain synonym table.
+func (s *classStorage) DomainSynonyms() (eridanus.DomainSynonyms, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.synonyms == nil {
+		m := make(eridanus.DomainSynonyms)
+		rc, err := s.be.Get(synonymsKey)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		default:
+			err = yaml.NewDecoder(rc).Decode(&m)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.synonyms = m
+	}
+	m := make(eridanus.DomainSynonyms, len(s.synonyms))
+	for alias, canonical := range s.synonyms {
+		m[alias] = canonical
+	}
+	return m, nil
+}
+
+// SetDomainSynonym stores alias as a synonym of the canonical domain, or
+// removes it if canonical is empty.
+func (s *classStorage) SetDomainSynonym(alias, canonical string) error {
+	alias, canonical = strings.ToLower(alias), strings.ToLower(canonical)
+	if alias == "" {
+		return fmt.Errorf("empty domain synonym")
+	}
+	m, err := s.DomainSynonyms()
+	if err != nil {
+		return err
+	}
+	if canonical == "" || canonical == alias {
+		delete(m, alias)
+	} else {
+		m[alias] = canonical
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := yaml.NewEncoder(buf).Encode(m); err != nil {
 		return err
 	}
-	return s.be.Set(cPath, buf)
+	if err := s.be.Set(synonymsKey, buf); err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// OnChange registers a function to be called after each change.
+func (s *classStorage) OnChange(f func()) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.hooks = append(s.hooks, f)
+}
+
+// changed drops the cached results and calls the registered hooks.
+func (s *classStorage) changed() {
+	s.m.Lock()
+	s.all, s.synonyms = nil, nil
+	hooks := append([]func(){}, s.hooks...)
+	s.m.Unlock()
+	for _, f := range hooks {
+		f()
+	}
 }
 
 func (s *classStorage) Has(name string) bool {
@@ -56,6 +290,7 @@ func (s *classStorage) Get(name string) (*eridanus.URLClass, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rc.Close()
 	var retval eridanus.URLClass
 	if err := yaml.NewDecoder(rc).Decode(&retval); err != nil {
 		return nil, err
@@ -65,48 +300,47 @@ func (s *classStorage) Get(name string) (*eridanus.URLClass, error) {
 
 // GetAll returns all current classifiers.
 func (s *classStorage) GetAll() ([]*eridanus.URLClass, error) {
-	var vs []*eridanus.URLClass
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.all != nil {
+		return append([]*eridanus.URLClass(nil), s.all...), nil
+	}
+
+	vs := []*eridanus.URLClass{} // not nil, so that an empty store is cached
 	keys, err := s.be.Keys(classesNamespace)
+	if err != nil {
+		return nil, err
+	}
 	for _, k := range keys {
 		rc, err := s.be.Get(k)
 		if err != nil {
 			return nil, err
 		}
-		defer rc.Close()
-
 		var v *eridanus.URLClass
-		if err := yaml.NewDecoder(rc).Decode(&v); err != nil {
+		err = yaml.NewDecoder(rc).Decode(&v)
+		rc.Close()
+		if err != nil {
 			return nil, err
 		}
 		vs = append(vs, v)
 	}
-	if err != nil || len(vs) == 0 {
-		vs = eridanus.DefaultClasses() // only if none existing
-	}
-	return vs, nil
+	s.all = vs
+	return append([]*eridanus.URLClass(nil), vs...), nil
 }
 
+// For returns the highest priority class matching the URL.
 func (s *classStorage) For(u *url.URL) (*eridanus.URLClass, error) {
-	var ucKeep *eridanus.URLClass
-	var urlKeep *url.URL
-
 	classes, err := s.GetAll()
 	if err != nil {
 		return nil, err
 	}
-
-	for _, uc := range classes {
-		if ucKeep != nil && ucKeep.GetPriority() >= uc.GetPriority() {
-			continue
-		}
-		nu, err := eridanus.ApplyClassifier(uc, u)
-		if err != nil {
-			continue
-		}
-		ucKeep, urlKeep = uc, nu
+	synonyms, err := s.DomainSynonyms()
+	if err != nil {
+		return nil, err
 	}
-	if ucKeep != nil && urlKeep != nil {
-		return ucKeep, nil
+	uc, _, _, err := eridanus.Classify(u, classes, synonyms)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.Errorf("no classifier for %s", u)
+	return uc, nil
 }
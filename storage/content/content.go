@@ -7,14 +7,18 @@ import (
 	"image/png"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"time"
 
 	"github.com/nfnt/resize"
 	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	contentNamespace   = "content"
 	thumbnailNamespace = "thumbnail"
+	infoNamespace      = "info"
 )
 
 type contentStorage struct{ be eridanus.StorageBackend }
@@ -60,9 +64,53 @@ func (s *contentStorage) Put(r io.Reader) (out eridanus.IDHash, err error) {
 		return "", err
 	}
 
+	iPath := fmt.Sprintf("%s/%s", infoNamespace, idHash)
+	if !s.be.Has(iPath) { // keep the first import time
+		info, err := yaml.Marshal(&eridanus.ContentInfo{
+			Size:     int64(len(cBytes)),
+			MIME:     http.DetectContentType(cBytes),
+			Imported: time.Now().UTC(),
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := s.be.Set(iPath, bytes.NewReader(info)); err != nil {
+			return "", err
+		}
+	}
+
 	return idHash, nil
 }
 
+// Info describes the content for the given hash, derived from the content if
+// it was stored without a description.
+func (s *contentStorage) Info(idHash eridanus.IDHash) (*eridanus.ContentInfo, error) {
+	iPath := fmt.Sprintf("%s/%s", infoNamespace, idHash)
+	if s.be.Has(iPath) {
+		r, err := s.be.Get(iPath)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		var info eridanus.ContentInfo
+		if err := yaml.NewDecoder(r).Decode(&info); err != nil {
+			return nil, err
+		}
+		return &info, nil
+	}
+
+	r, err := s.Get(idHash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &eridanus.ContentInfo{Size: int64(len(cBytes)), MIME: http.DetectContentType(cBytes)}, nil
+}
+
 // Get provides a reader of the content for the given hash.
 func (s *contentStorage) Get(idHash eridanus.IDHash) (io.ReadCloser, error) {
 	cPath := fmt.Sprintf("%s/%s", contentNamespace, idHash)
@@ -25,6 +25,7 @@ const (
 	cookiesBlobKey     = "config/cookies.json"
 	webcacheNamespace  = "web_cache"
 	webresultNamespace = "web_result"
+	fixturesNamespace  = "fixtures"
 )
 
 type fetcherStorage struct {
@@ -91,57 +92,160 @@ func (s *fetcherStorage) SetResults(u *url.URL, r *eridanus.ParseResults) error
 	return s.be.Set(rPath, strings.NewReader(proto.CompactTextString(r)))
 }
 
+// UpdateResults calls update with each stored ParseResults, storing those it
+// reports as changed.
+func (s *fetcherStorage) UpdateResults(update func(*eridanus.ParseResults) bool) error {
+	keys, err := s.be.Keys(webresultNamespace + "/")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		rc, err := s.be.Get(k)
+		if err != nil {
+			return err
+		}
+		d, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		var r eridanus.ParseResults
+		if err := proto.UnmarshalText(string(d), &r); err != nil {
+			return err
+		}
+		if !update(&r) {
+			continue
+		}
+		if err := s.be.Set(k, strings.NewReader(proto.CompactTextString(&r))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *fetcherStorage) GetCached(u *url.URL) (*http.Response, error) {
+	return s.getResponse(webcacheNamespace, u)
+}
+
+func (s *fetcherStorage) SetCached(u *url.URL, res *http.Response) error {
+	return s.setResponse(webcacheNamespace, u, res)
+}
+
+// GetFixture returns the fixture stored for the URL, as imported with a
+// bundle. Fixtures are kept apart from the web cache, so are never served in
+// place of fetching; the fixtures namespace may be replayed by a
+// ReplayTransport.
+func (s *fetcherStorage) GetFixture(u *url.URL) (*http.Response, error) {
+	return s.getResponse(fixturesNamespace, u)
+}
+
+// SetFixture stores a fixture for the URL.
+func (s *fetcherStorage) SetFixture(u *url.URL, res *http.Response) error {
+	return s.setResponse(fixturesNamespace, u, res)
+}
+
+func (s *fetcherStorage) getResponse(ns string, u *url.URL) (*http.Response, error) {
 	hsh := fmt.Sprintf("%x", md5.Sum([]byte(u.String())))
-	cPath := fmt.Sprintf("%s/%s", webcacheNamespace, hsh)
+	cPath := fmt.Sprintf("%s/%s", ns, hsh)
 	rc, err := s.be.Get(cPath)
 	if err != nil {
 		return nil, err
 	}
 	defer rc.Close()
+	return ReadCached(rc)
+}
+
+func (s *fetcherStorage) setResponse(ns string, u *url.URL, res *http.Response) error {
+	hsh := fmt.Sprintf("%x", md5.Sum([]byte(u.String())))
+	cPath := fmt.Sprintf("%s/%s", ns, hsh)
+	buf := bytes.NewBuffer(nil)
+	if err := WriteCached(buf, res); err != nil {
+		return err
+	}
+	return s.be.Set(cPath, buf)
+}
+
+func (s *fetcherStorage) DeleteCached(u *url.URL) error {
+	hsh := fmt.Sprintf("%x", md5.Sum([]byte(u.String())))
+	cPath := fmt.Sprintf("%s/%s", webcacheNamespace, hsh)
+	if err := s.be.Delete(cPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadCached reads a response in the format written by WriteCached.
+//
+// The response is read fully into memory, so r may be closed once ReadCached
+// returns.
+func ReadCached(r io.Reader) (*http.Response, error) {
+	br := bufio.NewReader(r)
 
 	var reqSize int64
-	if _, err := fmt.Fscanln(rc, &reqSize); err != nil {
+	if _, err := fmt.Fscanln(br, &reqSize); err != nil {
 		return nil, err
 	}
-
-	reqBuf := io.LimitReader(rc, int64(reqSize))
-	req, err := http.ReadRequest(bufio.NewReader(reqBuf))
-	if err != nil {
+	reqBuf := make([]byte, reqSize)
+	if _, err := io.ReadFull(br, reqBuf); err != nil {
 		return nil, err
 	}
+	var req *http.Request
+	if reqSize > 0 {
+		r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqBuf)))
+		if err != nil {
+			return nil, err
+		}
+		req = r
+	}
 
 	var resSize int64
-	if _, err := fmt.Fscanln(rc, &resSize); err != nil {
+	if _, err := fmt.Fscanln(br, &resSize); err != nil {
 		return nil, err
 	}
-
-	resBuf := io.LimitReader(rc, int64(resSize))
-	res, err := http.ReadResponse(bufio.NewReader(resBuf), req)
-	if err != nil {
+	resBuf := make([]byte, resSize)
+	if _, err := io.ReadFull(br, resBuf); err != nil {
 		return nil, err
 	}
-
-	return res, nil
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(resBuf)), req)
 }
 
-func (s *fetcherStorage) SetCached(u *url.URL, res *http.Response) error {
-	hsh := fmt.Sprintf("%x", md5.Sum([]byte(u.String())))
-	cPath := fmt.Sprintf("%s/%s", webcacheNamespace, hsh)
+// WriteCached writes a response and the request that produced it as two
+// length prefixed blocks in HTTP/1.1 wire format.
+//
+// The response body is consumed and replaced, so res remains readable.
+func WriteCached(w io.Writer, res *http.Response) error {
+	var body []byte
+	if res.Body != nil {
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = b
+	}
 
 	resBuf := bytes.NewBuffer(nil)
-	res.Write(resBuf)
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	if err := res.Write(resBuf); err != nil {
+		return err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
 
 	reqBuf := bytes.NewBuffer(nil)
 	if res.Request != nil {
-		res.Request.Write(reqBuf)
+		req := res.Request.WithContext(res.Request.Context())
+		req.Body, req.GetBody, req.ContentLength = nil, nil, 0
+		if err := req.Write(reqBuf); err != nil {
+			return err
+		}
 	}
 
-	buf := bytes.NewBuffer(nil)
-	fmt.Fprintf(buf, "%d\n%s", reqBuf.Len(), reqBuf.Bytes())
-	fmt.Fprintf(buf, "%d\n%s", resBuf.Len(), resBuf.Bytes())
-
-	return s.be.Set(cPath, buf)
+	if _, err := fmt.Fprintf(w, "%d\n%s", reqBuf.Len(), reqBuf.Bytes()); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d\n%s", resBuf.Len(), resBuf.Bytes())
+	return err
 }
 
 // Cookies implements the Cookies method of the http.CookieJar interface.
@@ -0,0 +1,243 @@
+// Package history records the versions of named definitions, such as classes
+// and parsers.
+package history
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	historyNamespace = "history"
+)
+
+// record is a stored version.
+type record struct {
+	Version uint64    `yaml:"version"`
+	Time    time.Time `yaml:"time"`
+	Author  string    `yaml:"author"`
+	Data    string    `yaml:"data"`
+}
+
+// History records the versions of definitions stored under a namespace.
+type History struct {
+	be eridanus.StorageBackend
+	ns string
+	m  sync.Mutex
+}
+
+// NewHistory provides a new History for definitions of the namespace.
+func NewHistory(be eridanus.StorageBackend, ns string) *History {
+	return &History{be: be, ns: ns}
+}
+
+func (h *History) prefix(name string) string {
+	return fmt.Sprintf("%s/%s/%s/", historyNamespace, h.ns, name)
+}
+
+// versions returns the recorded version numbers of name, in order.
+func (h *History) versions(name string) ([]uint64, error) {
+	keys, err := h.be.Keys(h.prefix(name))
+	if err != nil {
+		return nil, err
+	}
+	var vs []uint64
+	for _, k := range keys {
+		v, err := strconv.ParseUint(strings.TrimPrefix(k, h.prefix(name)), 10, 64)
+		if err != nil {
+			continue
+		}
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	return vs, nil
+}
+
+func (h *History) get(name string, version uint64) (*record, error) {
+	rc, err := h.be.Get(h.prefix(name) + strconv.FormatUint(version, 10))
+	if err != nil {
+		return nil, fmt.Errorf("%s %q version %d: %w", h.ns, name, version, err)
+	}
+	defer rc.Close()
+	var r record
+	if err := yaml.NewDecoder(rc).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Record stores data as the next version of name, returning its version and
+// that it was added. If data is unchanged from the latest version, that
+// version is returned and nothing is added.
+func (h *History) Record(name, author string, data []byte) (uint64, bool, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	vs, err := h.versions(name)
+	if err != nil {
+		return 0, false, err
+	}
+	r := &record{Version: 1, Time: time.Now().UTC(), Author: author, Data: string(data)}
+	if len(vs) > 0 {
+		last, err := h.get(name, vs[len(vs)-1])
+		if err != nil {
+			return 0, false, err
+		}
+		if last.Data == r.Data {
+			return last.Version, false, nil
+		}
+		r.Version = last.Version + 1
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := yaml.NewEncoder(buf).Encode(r); err != nil {
+		return 0, false, err
+	}
+	if err := h.be.Set(h.prefix(name)+strconv.FormatUint(r.Version, 10), buf); err != nil {
+		return 0, false, err
+	}
+	return r.Version, true, nil
+}
+
+// Forget removes a version of name, as when storing the definition it was
+// recorded for failed.
+func (h *History) Forget(name string, version uint64) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.be.Delete(h.prefix(name) + strconv.FormatUint(version, 10))
+}
+
+// Move moves the recorded versions of from to be those of to, replacing any
+// recorded for to.
+func (h *History) Move(from, to string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	stale, err := h.be.Keys(h.prefix(to))
+	if err != nil {
+		return err
+	}
+	for _, k := range stale {
+		if err := h.be.Delete(k); err != nil {
+			return err
+		}
+	}
+	keys, err := h.be.Keys(h.prefix(from))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		rc, err := h.be.Get(k)
+		if err != nil {
+			return err
+		}
+		err = h.be.Set(h.prefix(to)+strings.TrimPrefix(k, h.prefix(from)), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := h.be.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Data returns the data recorded as a version of name.
+func (h *History) Data(name string, version uint64) ([]byte, error) {
+	r, err := h.get(name, version)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(r.Data), nil
+}
+
+// Versions returns the recorded versions of name, oldest first, each with a
+// diff from the version before it.
+func (h *History) Versions(name string) ([]*eridanus.Revision, error) {
+	vs, err := h.versions(name)
+	if err != nil {
+		return nil, err
+	}
+	var out []*eridanus.Revision
+	var prev string
+	for _, v := range vs {
+		r, err := h.get(name, v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &eridanus.Revision{
+			Version: r.Version,
+			Time:    r.Time,
+			Author:  r.Author,
+			Diff:    Diff(prev, r.Data),
+		})
+		prev = r.Data
+	}
+	return out, nil
+}
+
+// Diff returns the differences between two recorded versions of name.
+func (h *History) Diff(name string, a, b uint64) (string, error) {
+	ra, err := h.get(name, a)
+	if err != nil {
+		return "", err
+	}
+	rb, err := h.get(name, b)
+	if err != nil {
+		return "", err
+	}
+	return Diff(ra.Data, rb.Data), nil
+}
+
+// Diff returns a line diff of a to b, with removed lines prefixed by "-",
+// added lines by "+", and unchanged lines by a space.
+func Diff(a, b string) string {
+	al, bl := splitLines(a), splitLines(b)
+	// lcs[i][j] is the length of the longest common subsequence of al[i:] and bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			fmt.Fprintf(&out, " %s\n", al[i])
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "-%s\n", al[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+%s\n", bl[j])
+			j++
+		}
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,26 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for i, test := range []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"", "a\n", "+a\n"},
+		{"a\n", "", "-a\n"},
+		{"a\nb\nc\n", "a\nb\nc\n", " a\n b\n c\n"},
+		{"a\nb\nc\n", "a\nx\nc\n", " a\n-b\n+x\n c\n"},
+		{"a\nb\n", "b\nc\n", "-a\n b\n+c\n"},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if got := Diff(test.a, test.b); got != test.want {
+				t.Errorf("Diff(%q, %q): got %q, want %q", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
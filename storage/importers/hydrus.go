@@ -0,0 +1,714 @@
+package importers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scytrin/eridanus"
+)
+
+// https://github.com/hydrusnetwork/hydrus/blob/master/hydrus/core/HydrusSerialisable.py
+// https://github.com/hydrusnetwork/hydrus/blob/master/hydrus/client/networking/ClientNetworkingURLClass.py
+// https://github.com/hydrusnetwork/hydrus/blob/master/hydrus/client/ClientParsing.py
+
+// Hydrus serialisable object types.
+const (
+	hydrusTypeList          = 26
+	hydrusFormulaHTML       = 27
+	hydrusContentParser     = 30
+	hydrusFormulaJSON       = 31
+	hydrusURLClass          = 50
+	hydrusStringMatch       = 51
+	hydrusStringConverter   = 55
+	hydrusPageParser        = 58
+	hydrusFormulaCompound   = 59
+	hydrusFormulaContextVar = 60
+	hydrusRuleHTML          = 62
+)
+
+// Hydrus url types, for url classes and url content parsers.
+const (
+	hydrusURLPost       = 0
+	hydrusURLAPI        = 1
+	hydrusURLFile       = 2
+	hydrusURLGallery    = 3
+	hydrusURLWatchable  = 4
+	hydrusURLNext       = 6
+	hydrusURLDesired    = 7
+	hydrusURLSource     = 8
+	hydrusURLSubGallery = 9
+)
+
+// Hydrus content types, for content parsers.
+const (
+	hydrusContentMappings = 0
+	hydrusContentURLs     = 7
+	hydrusContentVeto     = 8
+	hydrusContentHash     = 15
+	hydrusContentTime     = 16
+	hydrusContentTitle    = 17
+)
+
+// Hydrus string match types and flexible kinds.
+const (
+	hydrusMatchFixed    = 0
+	hydrusMatchFlexible = 1
+	hydrusMatchRegex    = 2
+	hydrusMatchAny      = 3
+
+	hydrusFlexAlpha   = 0
+	hydrusFlexAlnum   = 1
+	hydrusFlexNumeric = 2
+)
+
+// Hydrus string conversion types supported as parser operations.
+const (
+	hydrusConvPrepend = 4
+	hydrusConvAppend  = 5
+)
+
+// HydrusReport lists what was converted from a Hydrus export, and the
+// constructs that were dropped or approximated.
+type HydrusReport struct {
+	Classes     []string `json:"classes"`
+	Parsers     []string `json:"parsers"`
+	Unsupported []string `json:"unsupported"`
+}
+
+func (r *HydrusReport) unsupported(format string, args ...interface{}) {
+	r.Unsupported = append(r.Unsupported, fmt.Sprintf(format, args...))
+}
+
+// hydrusObject is a decoded Hydrus serialisable tuple, either
+// [type, version, info] or, for named objects, [type, name, version, info].
+type hydrusObject struct {
+	Type    int
+	Name    string
+	Version int
+	Info    []interface{}
+}
+
+func decodeHydrusObject(v interface{}) (*hydrusObject, bool) {
+	l, ok := v.([]interface{})
+	if !ok || len(l) < 3 || len(l) > 4 {
+		return nil, false
+	}
+	t, ok := hydrusInt(l[0])
+	if !ok {
+		return nil, false
+	}
+	o := &hydrusObject{Type: t}
+	if len(l) == 4 {
+		if o.Name, ok = l[1].(string); !ok {
+			return nil, false
+		}
+		l = l[1:]
+	}
+	if o.Version, ok = hydrusInt(l[1]); !ok {
+		return nil, false
+	}
+	switch info := l[2].(type) {
+	case []interface{}:
+		o.Info = info
+	default:
+		o.Info = []interface{}{info}
+	}
+	return o, true
+}
+
+func hydrusInt(v interface{}) (int, bool) {
+	f, ok := v.(float64)
+	return int(f), ok && f == float64(int(f))
+}
+
+func hydrusString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func hydrusBool(v interface{}) bool {
+	b, _ := v.(bool)
+	return b
+}
+
+func hydrusItem(l []interface{}, i int) interface{} {
+	if i < 0 || i >= len(l) {
+		return nil
+	}
+	return l[i]
+}
+
+func hydrusList(v interface{}) []interface{} {
+	l, _ := v.([]interface{})
+	return l
+}
+
+// ConvertHydrus converts the url classes and page parsers of a Hydrus
+// downloader export into a bundle. Constructs without an equivalent are
+// listed in the report rather than failing the conversion.
+func ConvertHydrus(r io.Reader) (*eridanus.Bundle, *HydrusReport, error) {
+	var v interface{}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, nil, err
+	}
+	o, ok := decodeHydrusObject(v)
+	if !ok {
+		return nil, nil, fmt.Errorf("not a hydrus serialised object")
+	}
+
+	c := &hydrusConverter{
+		b: &eridanus.Bundle{
+			Name:        "hydrus",
+			Description: "converted from a Hydrus downloader export",
+			Created:     time.Now().UTC().Format(time.RFC3339),
+		},
+		report: &HydrusReport{},
+		names:  make(map[string]bool),
+	}
+	c.convert(o)
+	return c.b, c.report, nil
+}
+
+type hydrusConverter struct {
+	b      *eridanus.Bundle
+	report *HydrusReport
+	names  map[string]bool
+}
+
+func (c *hydrusConverter) convert(o *hydrusObject) {
+	switch o.Type {
+	case hydrusTypeList:
+		for _, v := range o.Info {
+			if e, ok := decodeHydrusObject(v); ok {
+				c.convert(e)
+			} else {
+				c.report.unsupported("list item is not a serialised object")
+			}
+		}
+	case hydrusURLClass:
+		c.convertURLClass(o)
+	case hydrusPageParser:
+		c.convertPageParser(o)
+	default:
+		c.report.unsupported("%q: object type %d", o.Name, o.Type)
+	}
+}
+
+// name returns a valid name unused within the bundle.
+func (c *hydrusConverter) name(kind, name string) string {
+	clean := strings.NewReplacer("/", "-", `\`, "-").Replace(name)
+	if clean != name {
+		c.report.unsupported("%s %q: path separators replaced in name", kind, name)
+	}
+	if eridanus.ValidateName(clean) != nil {
+		clean = kind
+	}
+	unique := clean
+	for i := 2; c.names[kind+unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)", clean, i)
+	}
+	c.names[kind+unique] = true
+	return unique
+}
+
+// URL class info is [key, url type, scheme, netloc, booleans, path components,
+// parameters, ... example url], the items between the parameters and the
+// example url differing between versions.
+func (c *hydrusConverter) convertURLClass(o *hydrusObject) {
+	uc := &eridanus.URLClass{Name: c.name("class", o.Name)}
+
+	urlType, _ := hydrusInt(hydrusItem(o.Info, 1))
+	switch urlType {
+	case hydrusURLPost:
+		uc.Class = eridanus.URLClass_POST
+	case hydrusURLFile:
+		uc.Class = eridanus.URLClass_FILE
+	case hydrusURLGallery, hydrusURLWatchable:
+		uc.Class = eridanus.URLClass_LIST
+	default:
+		c.report.unsupported("class %q: url type %d", o.Name, urlType)
+		return
+	}
+	uc.AllowHttp = hydrusString(hydrusItem(o.Info, 2)) == "http"
+	uc.Domain = strings.ToLower(hydrusString(hydrusItem(o.Info, 3)))
+
+	flags := hydrusList(hydrusItem(o.Info, 4))
+	uc.MatchSubdomain = hydrusBool(hydrusItem(flags, 0))
+	uc.AllowSubdomain = hydrusBool(hydrusItem(flags, 1))
+	uc.KeepFragment = hydrusBool(hydrusItem(flags, 5))
+
+	for i, v := range hydrusList(hydrusItem(o.Info, 5)) {
+		// [string match, default], or a bare string match in older versions
+		sm, def := v, interface{}(nil)
+		if pair := hydrusList(v); len(pair) == 2 {
+			if _, ok := decodeHydrusObject(pair[0]); ok {
+				sm, def = pair[0], pair[1]
+			}
+		}
+		m := c.stringMatcher(fmt.Sprintf("class %q path %d", o.Name, i), sm)
+		if m == nil {
+			return
+		}
+		m.Default = hydrusString(def)
+		uc.Path = append(uc.Path, m)
+	}
+
+	params := make(map[string]interface{})
+	switch ps := hydrusItem(o.Info, 6).(type) {
+	case []interface{}: // [[key, [string match, default]], ...]
+		for _, p := range ps {
+			if kv := hydrusList(p); len(kv) == 2 {
+				params[hydrusString(kv[0])] = kv[1]
+			}
+		}
+	case map[string]interface{}:
+		params = ps
+	}
+	for key, v := range params {
+		sm, def := v, interface{}(nil)
+		if pair := hydrusList(v); len(pair) == 2 {
+			if _, ok := decodeHydrusObject(pair[0]); ok {
+				sm, def = pair[0], pair[1]
+			}
+		}
+		m := c.stringMatcher(fmt.Sprintf("class %q param %q", o.Name, key), sm)
+		if m == nil {
+			return
+		}
+		m.Default = hydrusString(def)
+		if uc.Query == nil {
+			uc.Query = make(map[string]*eridanus.StringMatcher)
+		}
+		uc.Query[key] = m
+	}
+
+	if len(o.Info) > 7 {
+		if example := hydrusString(o.Info[len(o.Info)-1]); example != "" {
+			uc.Examples = append(uc.Examples, example)
+		}
+		if hydrusBool(o.Info[7]) { // only a flag in versions with single value parameters
+			c.report.unsupported("class %q: single value parameters", o.Name)
+		}
+		for _, v := range o.Info[7 : len(o.Info)-1] {
+			if sc, ok := decodeHydrusObject(v); ok && sc.Type == hydrusStringConverter && len(hydrusList(hydrusItem(sc.Info, 0))) > 0 {
+				c.report.unsupported("class %q: url converters", o.Name)
+			}
+		}
+	}
+
+	if err := eridanus.ValidateURLClass(uc); err != nil {
+		c.report.unsupported("class %q: %v", o.Name, err)
+		return
+	}
+	c.b.Classes = append(c.b.Classes, uc)
+	c.report.Classes = append(c.report.Classes, uc.GetName())
+}
+
+// stringMatcher converts a serialised string match, info
+// [match type, match value, min chars, max chars, example].
+func (c *hydrusConverter) stringMatcher(where string, v interface{}) *eridanus.StringMatcher {
+	o, ok := decodeHydrusObject(v)
+	if !ok || o.Type != hydrusStringMatch {
+		c.report.unsupported("%s: not a string match", where)
+		return nil
+	}
+	matchType, _ := hydrusInt(hydrusItem(o.Info, 0))
+	value := hydrusItem(o.Info, 1)
+	min, hasMin := hydrusInt(hydrusItem(o.Info, 2))
+	max, hasMax := hydrusInt(hydrusItem(o.Info, 3))
+	bounded := (hasMin && min > 0) || hasMax
+
+	var class string
+	switch matchType {
+	case hydrusMatchFixed:
+		return &eridanus.StringMatcher{Value: hydrusString(value)}
+	case hydrusMatchRegex:
+		// hydrus searches for the pattern anywhere in the value
+		if bounded {
+			c.report.unsupported("%s: length limits on a regex", where)
+		}
+		return &eridanus.StringMatcher{Type: eridanus.StringMatcher_REGEX, Value: hydrusString(value), Partial: true}
+	case hydrusMatchAny:
+		if !bounded {
+			return &eridanus.StringMatcher{Type: eridanus.StringMatcher_ANY}
+		}
+		class = `[^/]`
+	case hydrusMatchFlexible:
+		kind, _ := hydrusInt(value)
+		var m eridanus.StringMatcher_MatcherType
+		switch kind {
+		case hydrusFlexAlpha:
+			m, class = eridanus.StringMatcher_ALPHAS, `[A-Za-z]`
+		case hydrusFlexAlnum:
+			m, class = eridanus.StringMatcher_ALNUMS, `[A-Za-z0-9]`
+		case hydrusFlexNumeric:
+			m, class = eridanus.StringMatcher_DIGITS, `[0-9]`
+		default:
+			c.report.unsupported("%s: flexible match kind %d", where, kind)
+			return nil
+		}
+		if !bounded {
+			return &eridanus.StringMatcher{Type: m}
+		}
+	default:
+		c.report.unsupported("%s: string match type %d", where, matchType)
+		return nil
+	}
+
+	if !hasMin || min < 1 {
+		min = 1
+	}
+	quantifier := fmt.Sprintf("{%d,}", min)
+	if hasMax {
+		quantifier = fmt.Sprintf("{%d,%d}", min, max)
+	}
+	return &eridanus.StringMatcher{Type: eridanus.StringMatcher_REGEX, Value: class + quantifier}
+}
+
+// Page parser info is [key, string converter, sub page parsers,
+// content parsers, example urls, ...].
+func (c *hydrusConverter) convertPageParser(o *hydrusObject) {
+	if sc, ok := decodeHydrusObject(hydrusItem(o.Info, 1)); ok && len(hydrusList(hydrusItem(sc.Info, 0))) > 0 {
+		c.report.unsupported("parser %q: pre-parsing conversion", o.Name)
+	}
+	if len(hydrusList(hydrusItem(o.Info, 2))) > 0 {
+		c.report.unsupported("parser %q: sub page parsers", o.Name)
+	}
+	var urls []string
+	for _, v := range hydrusList(hydrusItem(o.Info, 4)) {
+		if u := hydrusString(v); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		c.report.unsupported("parser %q: no example urls to apply it to", o.Name)
+	}
+
+	for _, v := range hydrusList(hydrusItem(o.Info, 3)) {
+		cp, ok := decodeHydrusObject(v)
+		if !ok || cp.Type != hydrusContentParser {
+			c.report.unsupported("parser %q: content parser is not a serialised object", o.Name)
+			continue
+		}
+		p := c.contentParser(o.Name, cp)
+		if p == nil {
+			continue
+		}
+		p.Urls = urls
+		c.b.Parsers = append(c.b.Parsers, p)
+		c.report.Parsers = append(c.report.Parsers, p.GetName())
+	}
+}
+
+// Content parser info is [name, content type, formula, ..., additional info].
+func (c *hydrusConverter) contentParser(page string, o *hydrusObject) *eridanus.Parser {
+	name := hydrusString(hydrusItem(o.Info, 0))
+	where := fmt.Sprintf("parser %q content %q", page, name)
+	contentType, _ := hydrusInt(hydrusItem(o.Info, 1))
+	extra := hydrusItem(o.Info, len(o.Info)-1)
+
+	p := &eridanus.Parser{Name: c.name("parser", page+": "+name)}
+	var prefix string
+	switch contentType {
+	case hydrusContentMappings:
+		p.Type = eridanus.ParseResultType_TAG
+		if ns := hydrusString(extra); ns != "" {
+			prefix = ns + ":"
+		}
+	case hydrusContentTitle:
+		p.Type, prefix = eridanus.ParseResultType_TAG, "title:"
+	case hydrusContentURLs:
+		urlType, _ := hydrusInt(hydrusItem(hydrusList(extra), 0))
+		switch urlType {
+		case hydrusURLDesired:
+			p.Type = eridanus.ParseResultType_CONTENT
+		case hydrusURLSource:
+			p.Type = eridanus.ParseResultType_SOURCE
+		case hydrusURLNext:
+			p.Type = eridanus.ParseResultType_NEXT
+		case hydrusURLSubGallery:
+			p.Type = eridanus.ParseResultType_FOLLOW
+		default:
+			c.report.unsupported("%s: url type %d", where, urlType)
+			return nil
+		}
+	case hydrusContentHash:
+		hash := hydrusString(extra) // [hash type, encoding] in later versions
+		if l := hydrusList(extra); l != nil {
+			hash = hydrusString(hydrusItem(l, 0))
+		}
+		if hash != "md5" {
+			c.report.unsupported("%s: %s hashes", where, hash)
+			return nil
+		}
+		p.Type = eridanus.ParseResultType_MD5SUM
+	case hydrusContentVeto:
+		c.report.unsupported("%s: vetoes", where)
+		return nil
+	case hydrusContentTime:
+		c.report.unsupported("%s: timestamps", where)
+		return nil
+	default:
+		c.report.unsupported("%s: content type %d", where, contentType)
+		return nil
+	}
+
+	ops, ok := c.formula(where, hydrusItem(o.Info, 2))
+	if !ok {
+		return nil
+	}
+	if prefix != "" {
+		ops = append(ops, &eridanus.Parser_Operation{Type: eridanus.Parser_Operation_PREFIX, Value: prefix})
+	}
+	p.Operations = ops
+	return p
+}
+
+// formula converts a serialised html or json formula into parser operations.
+func (c *hydrusConverter) formula(where string, v interface{}) ([]*eridanus.Parser_Operation, bool) {
+	o, ok := decodeHydrusObject(v)
+	if !ok {
+		c.report.unsupported("%s: formula is not a serialised object", where)
+		return nil, false
+	}
+
+	var op *eridanus.Parser_Operation
+	var filter, converter interface{}
+	switch o.Type {
+	case hydrusFormulaHTML: // [tag rules, content, attribute, string match, string converter]
+		op, ok = c.htmlFormula(where, o)
+		filter, converter = hydrusItem(o.Info, 3), hydrusItem(o.Info, 4)
+	case hydrusFormulaJSON: // [parse rules, content, string match, string converter]
+		op, ok = c.jsonFormula(where, o)
+		filter, converter = hydrusItem(o.Info, 2), hydrusItem(o.Info, 3)
+	case hydrusFormulaCompound:
+		c.report.unsupported("%s: compound formulae", where)
+		return nil, false
+	case hydrusFormulaContextVar:
+		c.report.unsupported("%s: context variable formulae", where)
+		return nil, false
+	default:
+		c.report.unsupported("%s: formula type %d", where, o.Type)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	ops := []*eridanus.Parser_Operation{op}
+
+	if f := c.filter(where, filter); f != nil {
+		ops = append(ops, f)
+	}
+	if sc, ok := decodeHydrusObject(converter); ok {
+		for _, v := range hydrusList(hydrusItem(sc.Info, 0)) {
+			conv := hydrusList(v)
+			convType, _ := hydrusInt(hydrusItem(conv, 0))
+			switch convType {
+			case hydrusConvPrepend:
+				ops = append(ops, &eridanus.Parser_Operation{Type: eridanus.Parser_Operation_PREFIX, Value: hydrusString(hydrusItem(conv, 1))})
+			case hydrusConvAppend:
+				ops = append(ops, &eridanus.Parser_Operation{Type: eridanus.Parser_Operation_SUFFIX, Value: hydrusString(hydrusItem(conv, 1))})
+			default:
+				c.report.unsupported("%s: string conversion type %d", where, convType)
+			}
+		}
+	}
+	return ops, true
+}
+
+// filter converts a formula's string match into a regex operation passing
+// only the values matching it.
+func (c *hydrusConverter) filter(where string, v interface{}) *eridanus.Parser_Operation {
+	if v == nil {
+		return nil
+	}
+	m := c.stringMatcher(where+" filter", v)
+	if m == nil {
+		return nil
+	}
+	var pattern string
+	switch m.GetType() {
+	case eridanus.StringMatcher_ANY:
+		return nil
+	case eridanus.StringMatcher_EXACT:
+		pattern = "^" + regexp.QuoteMeta(m.GetValue()) + "$"
+	case eridanus.StringMatcher_REGEX:
+		if m.GetPartial() {
+			pattern = "^.*(?:" + m.GetValue() + ").*$"
+		} else {
+			pattern = "^(?:" + m.GetValue() + ")$"
+		}
+	case eridanus.StringMatcher_ALPHAS:
+		pattern = `^[A-Za-z]+$`
+	case eridanus.StringMatcher_ALNUMS:
+		pattern = `^[A-Za-z0-9]+$`
+	case eridanus.StringMatcher_DIGITS:
+		pattern = `^[0-9]+$`
+	}
+	return &eridanus.Parser_Operation{Type: eridanus.Parser_Operation_REGEX, Value: "(?s)" + pattern}
+}
+
+// Hydrus html formula content and rule types.
+const (
+	hydrusHTMLAttribute = 0
+	hydrusHTMLString    = 1
+
+	hydrusRuleDescending = 0
+	hydrusRuleAscending  = 1
+)
+
+func (c *hydrusConverter) htmlFormula(where string, o *hydrusObject) (*eridanus.Parser_Operation, bool) {
+	var xpath strings.Builder
+	for _, v := range hydrusList(hydrusItem(o.Info, 0)) {
+		// [rule type, name, attributes, index, depth, test string, string match],
+		// or [name, attributes, index] in older versions
+		var rule []interface{}
+		if r, ok := decodeHydrusObject(v); ok && r.Type == hydrusRuleHTML {
+			rule = r.Info
+		} else if l := hydrusList(v); len(l) == 3 {
+			rule = append([]interface{}{float64(hydrusRuleDescending)}, l...)
+		} else {
+			c.report.unsupported("%s: tag rule", where)
+			return nil, false
+		}
+
+		tag := hydrusString(hydrusItem(rule, 1))
+		if tag == "" {
+			tag = "*"
+		}
+		ruleType, _ := hydrusInt(hydrusItem(rule, 0))
+		switch ruleType {
+		case hydrusRuleDescending:
+			var preds []string
+			attrs, _ := hydrusItem(rule, 2).(map[string]interface{})
+			keys := make([]string, 0, len(attrs))
+			for k := range attrs {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				lit, ok := xpathLiteral(hydrusString(attrs[k]))
+				if !ok {
+					c.report.unsupported("%s: attribute value with both quote kinds", where)
+					return nil, false
+				}
+				if k == "class" { // matched against each of an element's classes
+					preds = append(preds, fmt.Sprintf("contains(@class, %s)", lit))
+				} else {
+					preds = append(preds, fmt.Sprintf("@%s=%s", k, lit))
+				}
+			}
+			fmt.Fprintf(&xpath, "/descendant::%s", tag)
+			if index, ok := hydrusInt(hydrusItem(rule, 3)); ok {
+				if len(preds) > 0 {
+					c.report.unsupported("%s: tag index %d with attributes, all matches are kept", where, index)
+				} else {
+					preds = append(preds, fmt.Sprint(index+1))
+				}
+			}
+			if len(preds) > 0 {
+				fmt.Fprintf(&xpath, "[%s]", strings.Join(preds, " and "))
+			}
+		case hydrusRuleAscending:
+			depth, ok := hydrusInt(hydrusItem(rule, 4))
+			if !ok || depth < 1 {
+				depth = 1
+			}
+			fmt.Fprintf(&xpath, "/ancestor::%s[%d]", tag, depth)
+		default:
+			c.report.unsupported("%s: tag rule type %d", where, ruleType)
+			return nil, false
+		}
+		if hydrusBool(hydrusItem(rule, 5)) {
+			c.report.unsupported("%s: tag string tests", where)
+		}
+	}
+
+	content, _ := hydrusInt(hydrusItem(o.Info, 1))
+	switch content {
+	case hydrusHTMLAttribute:
+		fmt.Fprintf(&xpath, "/@%s", hydrusString(hydrusItem(o.Info, 2)))
+	case hydrusHTMLString:
+	default:
+		c.report.unsupported("%s: html content type %d", where, content)
+		return nil, false
+	}
+	return &eridanus.Parser_Operation{Type: eridanus.Parser_Operation_XPATH, Value: xpath.String()}, true
+}
+
+func xpathLiteral(s string) (string, bool) {
+	if !strings.Contains(s, "'") {
+		return "'" + s + "'", true
+	}
+	return `"` + s + `"`, !strings.Contains(s, `"`)
+}
+
+// Hydrus json formula content and rule types.
+const (
+	hydrusJSONString = 0
+	hydrusJSONJSON   = 1
+
+	hydrusJSONKey   = 0
+	hydrusJSONAll   = 1
+	hydrusJSONIndex = 2
+)
+
+func (c *hydrusConverter) jsonFormula(where string, o *hydrusObject) (*eridanus.Parser_Operation, bool) {
+	var keys []string
+	for _, v := range hydrusList(hydrusItem(o.Info, 0)) {
+		// [rule type, key string match or index], or a bare key, index or
+		// null for all items in older versions
+		var key string
+		switch r := v.(type) {
+		case string:
+			key = r
+		case float64:
+			key = fmt.Sprint(int(r))
+		case nil:
+			key = "*"
+		case []interface{}:
+			ruleType, _ := hydrusInt(hydrusItem(r, 0))
+			switch ruleType {
+			case hydrusJSONKey:
+				m := c.stringMatcher(where+" json key", hydrusItem(r, 1))
+				if m == nil {
+					return nil, false
+				}
+				if m.GetType() != eridanus.StringMatcher_EXACT {
+					c.report.unsupported("%s: json keys matched by pattern", where)
+					return nil, false
+				}
+				if key = m.GetValue(); key == "*" {
+					c.report.unsupported("%s: json key %q", where, key)
+					return nil, false
+				}
+			case hydrusJSONAll:
+				key = "*"
+			case hydrusJSONIndex:
+				index, _ := hydrusInt(hydrusItem(r, 1))
+				key = fmt.Sprint(index)
+			default:
+				c.report.unsupported("%s: json rule type %d", where, ruleType)
+				return nil, false
+			}
+		}
+		if strings.Contains(key, ".") || key == "" {
+			c.report.unsupported("%s: json key %q", where, key)
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+
+	switch content, _ := hydrusInt(hydrusItem(o.Info, 1)); content {
+	case hydrusJSONString, hydrusJSONJSON:
+	default:
+		c.report.unsupported("%s: json content type %d", where, content)
+		return nil, false
+	}
+	return &eridanus.Parser_Operation{Type: eridanus.Parser_Operation_JSON, Value: strings.Join(keys, ".")}, true
+}
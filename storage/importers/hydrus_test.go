@@ -0,0 +1,110 @@
+package importers
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+)
+
+// testHydrusExport holds a url class, a page parser with html and json
+// content parsers, and an object type with no equivalent.
+const testHydrusExport = `[26, 2, [
+	[50, "example post/page", 9, ["0123", 0, "https", "example.com",
+		[true, false, true, false, true, false],
+		[
+			[[51, 1, [0, "post", null, null, "post"]], null],
+			[[51, 1, [1, 2, null, null, "123"]], null]
+		],
+		[["page", [[51, 1, [1, 2, 1, 3, "1"]], "1"]]],
+		[55, 1, [[], ""]], false, [55, 1, [[], ""]],
+		"https://example.com/post/123?page=1"]],
+	[58, "example post parser", 2, ["4567", [55, 1, [[], ""]], [],
+		[
+			[30, 2, ["tags", 0, [27, 6, [
+				[[62, 1, [0, "ul", {"id": "tags"}, null, null, false, [51, 1, [3, "", null, null, ""]]]],
+				 [62, 1, [0, "a", {}, null, null, false, [51, 1, [3, "", null, null, ""]]]]],
+				1, null, [51, 1, [3, "", null, null, ""]], [55, 1, [[], ""]]]], "character"]],
+			[30, 2, ["image", 7, [27, 6, [
+				[[62, 1, [0, "img", {}, 0, null, false, [51, 1, [3, "", null, null, ""]]]]],
+				0, "src", [51, 1, [3, "", null, null, ""]], [55, 1, [[[4, "https://example.com"]], ""]]]], [7, 50]]],
+			[30, 2, ["md5", 15, [31, 2, [
+				[[0, [51, 1, [0, "file", null, null, ""]]], [0, [51, 1, [0, "md5", null, null, ""]]]],
+				0, [51, 1, [1, 1, null, null, ""]], [55, 1, [[], ""]]]], ["md5", "hex"]]],
+			[30, 2, ["rating", 16, [31, 2, [[], 0, null, null]], 0]],
+			[30, 2, ["parents", 0, [59, 2, [[], "", null, null]], ""]]
+		],
+		["https://example.com/post/123"], {}]],
+	[32, 1, []]
+]]`
+
+func TestConvertHydrus(t *testing.T) {
+	b, report, err := ConvertHydrus(strings.NewReader(testHydrusExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := fmt.Sprint(report.Classes), "[example post-page]"; got != want {
+		t.Errorf("classes: got %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(report.Parsers), "[example post parser: tags example post parser: image example post parser: md5]"; got != want {
+		t.Errorf("parsers: got %v, want %v", got, want)
+	}
+	for _, want := range []string{
+		`class "example post/page": path separators replaced in name`,
+		`parser "example post parser" content "rating": timestamps`,
+		`parser "example post parser" content "parents": compound formulae`,
+		`"": object type 32`,
+	} {
+		var found bool
+		for _, u := range report.Unsupported {
+			found = found || u == want
+		}
+		if !found {
+			t.Errorf("unsupported: got %q, want to include %q", report.Unsupported, want)
+		}
+	}
+
+	uc := b.GetClasses()[0]
+	u, err := url.Parse("https://www.example.com/post/123?page=2&extra=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := eridanus.ApplyClassifier(uc, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://example.com/post/123?page=2"; got.String() != want {
+		t.Errorf("ApplyClassifier: got %s, want %s", got, want)
+	}
+
+	body := `<html><body><ul id="tags"><li><a>Alice</a></li><li><a>Bob</a></li></ul><a>Nav</a>` +
+		`<img src="/img/1.png"><img src="/img/2.png"></body></html>`
+	for i, test := range []struct {
+		body string
+		want []string
+	}{
+		{body, []string{"character:alice", "character:bob"}},
+		{body, []string{"https://example.com/img/1.png"}},
+		{`{"file": {"md5": "d41d8cd98f00b204e9800998ecf8427e"}}`, []string{"d41d8cd98f00b204e9800998ecf8427e"}},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			p := b.GetParsers()[i]
+			if fmt.Sprint(p.GetUrls()) != "[https://example.com/post/123]" {
+				t.Errorf("urls: got %v", p.GetUrls())
+			}
+			r, err := eridanus.ApplyParser(p, &eridanus.ParseResult{Value: []string{test.body}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := r.GetValue()
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("%v: got %v, want %v", p.GetOperations(), got, test.want)
+			}
+		})
+	}
+}
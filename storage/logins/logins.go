@@ -0,0 +1,92 @@
+package logins
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	loginsNamespace = "logins"
+)
+
+type loginsStorage struct{ be eridanus.StorageBackend }
+
+// NewLoginsStorage provides a new LoginsStorage.
+func NewLoginsStorage(be eridanus.StorageBackend) eridanus.LoginsStorage {
+	return &loginsStorage{be}
+}
+
+// Names returns a list of all login names.
+func (s *loginsStorage) Names() ([]string, error) {
+	keys, err := s.be.Keys(loginsNamespace)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, loginsNamespace+"/")
+	}
+	return keys, nil
+}
+
+// Put adds a login.
+func (s *loginsStorage) Put(l *eridanus.Login) error {
+	lPath := fmt.Sprintf("%s/%s", loginsNamespace, l.GetName())
+	buf := bytes.NewBuffer(nil)
+	if err := yaml.NewEncoder(buf).Encode(l); err != nil {
+		return err
+	}
+	return s.be.Set(lPath, buf)
+}
+
+func (s *loginsStorage) Has(name string) bool {
+	lPath := fmt.Sprintf("%s/%s", loginsNamespace, name)
+	return s.be.Has(lPath)
+}
+
+// Get returns the named login.
+func (s *loginsStorage) Get(name string) (*eridanus.Login, error) {
+	lPath := fmt.Sprintf("%s/%s", loginsNamespace, name)
+	rc, err := s.be.Get(lPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var retval eridanus.Login
+	if err := yaml.NewDecoder(rc).Decode(&retval); err != nil {
+		return nil, err
+	}
+	return &retval, nil
+}
+
+// For returns the login for the URL's domain, preferring the most specific domain.
+func (s *loginsStorage) For(u *url.URL) (*eridanus.Login, error) {
+	names, err := s.Names()
+	if err != nil {
+		return nil, err
+	}
+
+	var keep *eridanus.Login
+	host := u.Hostname()
+	for _, name := range names {
+		l, err := s.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		if host != l.GetDomain() && !strings.HasSuffix(host, "."+l.GetDomain()) {
+			continue
+		}
+		if keep == nil || len(l.GetDomain()) > len(keep.GetDomain()) {
+			keep = l
+		}
+	}
+	if keep == nil {
+		return nil, errors.Errorf("no login for %s", u.Hostname())
+	}
+	return keep, nil
+}
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/history"
 	"gopkg.in/yaml.v3"
 )
 
@@ -14,11 +18,19 @@ const (
 	parsersNamespace = "parsers"
 )
 
-type parsersStorage struct{ be eridanus.StorageBackend }
+type parsersStorage struct {
+	be eridanus.StorageBackend
+	h  *history.History
+	w  sync.Mutex // serializes changes to stored parsers
+
+	m     sync.Mutex
+	all   []*eridanus.Parser // cached GetAll result, nil until read
+	hooks []func()
+}
 
 // NewParsersStorage provides a new ParsersStorage.
 func NewParsersStorage(be eridanus.StorageBackend) eridanus.ParsersStorage {
-	return &parsersStorage{be}
+	return &parsersStorage{be: be, h: history.NewHistory(be, parsersNamespace)}
 }
 
 // Names returns a list of all parser names.
@@ -33,14 +45,181 @@ func (s *parsersStorage) Names() ([]string, error) {
 	return keys, nil
 }
 
-// Put adds a parser.
+// Put adds a parser, if it is valid.
 func (s *parsersStorage) Put(p *eridanus.Parser) error {
+	return s.PutBy(p, "")
+}
+
+// PutBy adds a parser, if it is valid, recording it as a new version by author.
+func (s *parsersStorage) PutBy(p *eridanus.Parser, author string) error {
+	s.w.Lock()
+	err := s.put(p, author)
+	s.w.Unlock()
+	if err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// put stores the parser as a new version by author. It must be called with s.w
+// held.
+func (s *parsersStorage) put(p *eridanus.Parser, author string) error {
+	if err := eridanus.ValidateName(p.GetName()); err != nil {
+		return err
+	}
+	p = proto.Clone(p).(*eridanus.Parser)
+	p.Version = 0
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	version, added, err := s.h.Record(p.GetName(), author, data)
+	if err != nil {
+		return err
+	}
+	p.Version = version
+
 	pPath := fmt.Sprintf("%s/%s", parsersNamespace, p.GetName())
 	buf := bytes.NewBuffer(nil)
-	if err := yaml.NewEncoder(buf).Encode(p); err != nil {
+	err = yaml.NewEncoder(buf).Encode(p)
+	if err == nil {
+		err = s.be.Set(pPath, buf)
+	}
+	if err != nil && added { // leave no version of what was not stored
+		return undone(err, s.h.Forget(p.GetName(), version))
+	}
+	return err
+}
+
+// Versions returns the recorded versions of the named parser, oldest first.
+func (s *parsersStorage) Versions(name string) ([]*eridanus.Revision, error) {
+	return s.h.Versions(name)
+}
+
+// Diff returns the differences between two versions of the named parser.
+func (s *parsersStorage) Diff(name string, a, b uint64) (string, error) {
+	return s.h.Diff(name, a, b)
+}
+
+// Rollback restores a prior version of the named parser as a new version by author.
+func (s *parsersStorage) Rollback(name string, version uint64, author string) error {
+	data, err := s.h.Data(name, version)
+	if err != nil {
+		return err
+	}
+	var v eridanus.Parser
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v.Name = name // the version may predate a rename
+	return s.PutBy(&v, author)
+}
+
+// Delete removes the named parser.
+func (s *parsersStorage) Delete(name string) error {
+	s.w.Lock()
+	err := s.delete(name)
+	s.w.Unlock()
+	if err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// stored returns an error unless the named parser is stored. The name is not
+// validated, so that parsers stored under names since made invalid can still
+// be renamed or removed.
+func (s *parsersStorage) stored(name string) error {
+	names, err := s.Names()
+	if err != nil {
 		return err
 	}
-	return s.be.Set(pPath, buf)
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("parser %q: %w", name, os.ErrNotExist)
+}
+
+// delete removes the named parser. It must be called with s.w held.
+func (s *parsersStorage) delete(name string) error {
+	if err := s.stored(name); err != nil {
+		return err
+	}
+	return s.be.Delete(fmt.Sprintf("%s/%s", parsersNamespace, name))
+}
+
+// Rename renames a parser, failing if the new name is in use.
+func (s *parsersStorage) Rename(from, to string) error {
+	if err := eridanus.ValidateName(to); err != nil {
+		return err
+	}
+	s.w.Lock()
+	err := s.rename(from, to)
+	s.w.Unlock()
+	if err != nil {
+		return err
+	}
+	s.changed()
+	return nil
+}
+
+// rename stores the parser and its history under the new name then removes the
+// old, undoing the move if the old could not be. It must be called with s.w
+// held.
+func (s *parsersStorage) rename(from, to string) error {
+	if s.Has(to) {
+		return fmt.Errorf("parser %q already exists", to)
+	}
+	if err := s.stored(from); err != nil {
+		return err
+	}
+	v, err := s.Get(from)
+	if err != nil {
+		return err
+	}
+	v.Name = to
+	if err := s.h.Move(from, to); err != nil {
+		return err
+	}
+	if err := s.put(v, ""); err != nil {
+		return undone(err, s.h.Move(to, from))
+	}
+	if err := s.delete(from); err != nil {
+		return undone(err, s.be.Delete(fmt.Sprintf("%s/%s", parsersNamespace, to)), s.h.Move(to, from))
+	}
+	return nil
+}
+
+// undone returns err, noting any errors from undoing the changes before it.
+func undone(err error, undos ...error) error {
+	for _, uerr := range undos {
+		if uerr != nil {
+			err = fmt.Errorf("%v, and undoing: %v", err, uerr)
+		}
+	}
+	return err
+}
+
+// OnChange registers a function to be called after each change.
+func (s *parsersStorage) OnChange(f func()) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.hooks = append(s.hooks, f)
+}
+
+// changed drops the cached GetAll result and calls the registered hooks.
+func (s *parsersStorage) changed() {
+	s.m.Lock()
+	s.all = nil
+	hooks := append([]func(){}, s.hooks...)
+	s.m.Unlock()
+	for _, f := range hooks {
+		f()
+	}
 }
 
 func (s *parsersStorage) Has(name string) bool {
@@ -55,6 +234,7 @@ func (s *parsersStorage) Get(name string) (*eridanus.Parser, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rc.Close()
 	var retval eridanus.Parser
 	if err := yaml.NewDecoder(rc).Decode(&retval); err != nil {
 		return nil, err
@@ -64,29 +244,37 @@ func (s *parsersStorage) Get(name string) (*eridanus.Parser, error) {
 
 // GetAllParsers returns all current parsers.
 func (s *parsersStorage) GetAll() ([]*eridanus.Parser, error) {
-	var vs []*eridanus.Parser
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.all != nil {
+		return append([]*eridanus.Parser(nil), s.all...), nil
+	}
+
+	vs := []*eridanus.Parser{} // not nil, so that an empty store is cached
 	keys, err := s.be.Keys(parsersNamespace)
+	if err != nil {
+		return nil, err
+	}
 	for _, k := range keys {
 		rc, err := s.be.Get(k)
 		if err != nil {
 			return nil, err
 		}
-		defer rc.Close()
-
 		var v *eridanus.Parser
-		if err := yaml.NewDecoder(rc).Decode(&v); err != nil {
+		err = yaml.NewDecoder(rc).Decode(&v)
+		rc.Close()
+		if err != nil {
 			return nil, err
 		}
 		vs = append(vs, v)
 	}
-	if err != nil || len(vs) == 0 {
-		vs = eridanus.DefaultParsers() // only if none existing
-	}
-	return vs, nil
+	s.all = vs
+	return append([]*eridanus.Parser(nil), vs...), nil
 }
 
-// For returns a list of parsers applicable to the provided URLClass.
-func (s *parsersStorage) For(c *eridanus.URLClass) ([]*eridanus.Parser, error) {
+// For returns a list of parsers applicable to the provided URLClass, matching
+// their example URLs with the domain synonyms ds.
+func (s *parsersStorage) For(c *eridanus.URLClass, ds eridanus.DomainSynonyms) ([]*eridanus.Parser, error) {
 	parsers, err := s.GetAll()
 	if err != nil {
 		return nil, err
@@ -107,7 +295,7 @@ func (s *parsersStorage) For(c *eridanus.URLClass) ([]*eridanus.Parser, error) {
 			if err != nil {
 				return nil, err
 			}
-			if _, err := eridanus.ApplyClassifier(c, u); err == nil {
+			if _, err := eridanus.ApplyClassifier(c, u, ds); err == nil {
 				keep = append(keep, p)
 				break
 			}
@@ -9,6 +9,7 @@ import (
 	"github.com/scytrin/eridanus/storage/classes"
 	"github.com/scytrin/eridanus/storage/content"
 	"github.com/scytrin/eridanus/storage/fetcher"
+	"github.com/scytrin/eridanus/storage/logins"
 	"github.com/scytrin/eridanus/storage/parsers"
 	"github.com/scytrin/eridanus/storage/tags"
 	_ "golang.org/x/image/bmp"      // image decoding
@@ -32,11 +33,29 @@ const (
 )
 
 // Storage provides a default implementation of eridanus.Storage.
-type Storage struct{ be eridanus.StorageBackend }
+type Storage struct {
+	be eridanus.StorageBackend
+
+	cs eridanus.ClassesStorage
+	ps eridanus.ParsersStorage
+	ls eridanus.LoginsStorage
+	ts eridanus.TagStorage
+	ds eridanus.ContentStorage
+	fs eridanus.FetcherStorage
+}
 
 // NewStorage provides a new instance implementing Storage.
 func NewStorage(be eridanus.StorageBackend) *Storage {
-	return &Storage{be}
+	ds := content.NewContentStorage(be)
+	return &Storage{
+		be: be,
+		cs: classes.NewClassesStorage(be),
+		ps: parsers.NewParsersStorage(be),
+		ls: logins.NewLoginsStorage(be),
+		ts: tags.NewTagStorage(be, ds),
+		ds: ds,
+		fs: fetcher.NewFetcherStorage(be),
+	}
 }
 
 // Backend provides the StorageBackend.
@@ -46,25 +65,30 @@ func (s *Storage) Backend() eridanus.StorageBackend {
 
 // ClassesStorage provides a ClassesStorage.
 func (s *Storage) ClassesStorage() eridanus.ClassesStorage {
-	return classes.NewClassesStorage(s.be)
+	return s.cs
 }
 
 // ParsersStorage provides a ParsersStorage.
 func (s *Storage) ParsersStorage() eridanus.ParsersStorage {
-	return parsers.NewParsersStorage(s.be)
+	return s.ps
+}
+
+// LoginsStorage provides a LoginsStorage.
+func (s *Storage) LoginsStorage() eridanus.LoginsStorage {
+	return s.ls
 }
 
 // TagStorage provides a TagStorage.
 func (s *Storage) TagStorage() eridanus.TagStorage {
-	return tags.NewTagStorage(s.be)
+	return s.ts
 }
 
 // ContentStorage provides a ContentStorage.
 func (s *Storage) ContentStorage() eridanus.ContentStorage {
-	return content.NewContentStorage(s.be)
+	return s.ds
 }
 
 // FetcherStorage provides a FetcherStorage.
 func (s *Storage) FetcherStorage() eridanus.FetcherStorage {
-	return fetcher.NewFetcherStorage(s.be)
+	return s.fs
 }
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/backend/diskv"
+)
+
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	be := diskv.NewBackend(dir)
+	t.Cleanup(func() { be.Close() })
+	return NewStorage(be)
+}
+
+func TestRename(t *testing.T) {
+	s := newTestStorage(t)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{Name: "post", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{Name: "gallery", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ParsersStorage().Put(&eridanus.Parser{Name: "tags"}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse("https://example.com/post/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FetcherStorage().SetResults(u, &eridanus.ParseResults{Results: []*eridanus.ParseResult{
+		{Type: eridanus.ParseResultType_TAG, Value: []string{"hat"}, Parser: "tags", Uclass: "post"},
+		{Type: eridanus.ParseResultType_TAG, Value: []string{"cat"}, Uclass: "gallery"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := eridanus.RenameClass(s, "post", "gallery"); err == nil {
+		t.Error("RenameClass to an existing name: got nil, want error")
+	}
+	if err := eridanus.RenameClass(s, "post", "a/b"); err == nil {
+		t.Error("RenameClass to an invalid name: got nil, want error")
+	}
+	if err := eridanus.RenameClass(s, "post", "posts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eridanus.RenameParser(s, "tags", "post tags"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.ClassesStorage().Has("post") || !s.ClassesStorage().Has("posts") {
+		t.Error("class not renamed")
+	}
+	if uc, err := s.ClassesStorage().Get("posts"); err != nil || uc.GetName() != "posts" {
+		t.Errorf("Get(posts): got %v, %v, want posts", uc, err)
+	}
+	if s.ParsersStorage().Has("tags") || !s.ParsersStorage().Has("post tags") {
+		t.Error("parser not renamed")
+	}
+	results, err := s.FetcherStorage().GetResults(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][2]string{{"post tags", "posts"}, {"", "gallery"}} {
+		r := results.GetResults()[i]
+		if r.GetParser() != want[0] || r.GetUclass() != want[1] {
+			t.Errorf("results[%d]: got %q/%q, want %q/%q", i, r.GetParser(), r.GetUclass(), want[0], want[1])
+		}
+	}
+}
+
+func TestRenameLegacyName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	be := diskv.NewBackend(dir)
+	defer be.Close()
+	s := NewStorage(be)
+
+	// stored before names were validated
+	if err := be.Set("parsers/a/b", strings.NewReader("name: a/b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ParsersStorage().Rename("a/b", "a b"); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := s.ParsersStorage().Names(); err != nil || fmt.Sprint(names) != "[a b]" {
+		t.Errorf("Names after Rename: got %q, %v, want [\"a b\"]", names, err)
+	}
+
+	if err := be.Set("parsers/c/d", strings.NewReader("name: c/d\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ParsersStorage().Delete("c/d"); err != nil {
+		t.Fatal(err)
+	}
+	if s.ParsersStorage().Has("c/d") {
+		t.Error("legacy parser not deleted")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s := newTestStorage(t)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{Name: "post", Domain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if ucs, err := s.ClassesStorage().GetAll(); err != nil || len(ucs) != 1 {
+		t.Fatalf("GetAll: got %v, %v, want 1 class", ucs, err)
+	}
+	if err := s.ClassesStorage().Delete("post"); err != nil {
+		t.Fatal(err)
+	}
+	if s.ClassesStorage().Has("post") {
+		t.Error("class not deleted")
+	}
+	if err := s.ClassesStorage().Delete("post"); err == nil {
+		t.Error("Delete of a missing class: got nil, want error")
+	}
+	if err := s.ParsersStorage().Delete("../classes/post"); err == nil {
+		t.Error("Delete of an invalid name: got nil, want error")
+	}
+}
+
+func TestDomainSynonyms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	be := diskv.NewBackend(dir)
+	defer be.Close()
+
+	s := NewStorage(be)
+	if err := s.ClassesStorage().Put(&eridanus.URLClass{Name: "post", Domain: "e621.net"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ClassesStorage().SetDomainSynonym("E926.net", "e621.net"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh storage over the same backend loads the table
+	s = NewStorage(be)
+	synonyms, err := s.ClassesStorage().DomainSynonyms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(synonyms); got != "map[e926.net:e621.net]" {
+		t.Errorf("DomainSynonyms: got %s, want map[e926.net:e621.net]", got)
+	}
+	u, err := url.Parse("https://e926.net/posts/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uc, err := s.ClassesStorage().For(u); err != nil || uc.GetName() != "post" {
+		t.Errorf("For(%s): got %v, %v, want post", u, uc, err)
+	}
+
+	if err := s.ClassesStorage().SetDomainSynonym("e926.net", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ClassesStorage().For(u); err == nil {
+		t.Errorf("For(%s) after removing the synonym: got nil, want error", u)
+	}
+}
+
+func TestLegacyMatcherAlias(t *testing.T) {
+	s := newTestStorage(t)
+	uc := &eridanus.URLClass{Name: "post", Domain: "example.com", Path: []*eridanus.StringMatcher{
+		{Value: "post"},
+		{Type: eridanus.StringMatcher_REGEX, Value: "digits"},
+	}}
+	if err := s.ClassesStorage().Put(uc); err != nil {
+		t.Fatal(err)
+	}
+	if err := eridanus.RenameClass(s, "post", "posts"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.ClassesStorage().Get("posts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := got.GetPath()[1]; m.GetType() != eridanus.StringMatcher_DIGITS || m.GetValue() != "" {
+		t.Errorf("path[1]: got %v, want a DIGITS matcher", m)
+	}
+	if uc.GetPath()[1].GetType() != eridanus.StringMatcher_REGEX {
+		t.Error("Put modified its argument")
+	}
+}
+
+func TestVersions(t *testing.T) {
+	s := newTestStorage(t)
+	ps := s.ParsersStorage()
+	for _, put := range []struct {
+		p      *eridanus.Parser
+		author string
+	}{
+		{&eridanus.Parser{Name: "tags", Urls: []string{"https://example.com/post/1"}}, "alice"},
+		{&eridanus.Parser{Name: "tags", Urls: []string{"https://example.com/post/1"}}, "alice"}, // unchanged
+		{&eridanus.Parser{Name: "tags", Urls: []string{"https://example.com/post/2"}}, "bob"},
+	} {
+		if err := ps.PutBy(put.p, put.author); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revs, err := ps.Versions("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("Versions: got %d, want 2", len(revs))
+	}
+	if revs[1].Version != 2 || revs[1].Author != "bob" || revs[1].Time.IsZero() {
+		t.Errorf("Versions[1]: got %+v, want version 2 by bob", revs[1])
+	}
+	want := "-    - https://example.com/post/1\n+    - https://example.com/post/2\n"
+	if diff, err := ps.Diff("tags", 1, 2); err != nil || !strings.Contains(diff, want) {
+		t.Errorf("Diff(1, 2): got %q, %v, want to contain %q", diff, err, want)
+	}
+	if p, err := ps.Get("tags"); err != nil || p.GetVersion() != 2 {
+		t.Errorf("Get: got %v, %v, want version 2", p, err)
+	}
+
+	if err := ps.Rollback("tags", 1, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ps.Get("tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.GetVersion() != 3 || p.GetUrls()[0] != "https://example.com/post/1" {
+		t.Errorf("Get after Rollback: got %v, want version 3 of version 1", p)
+	}
+	if err := ps.Rollback("tags", 9, "carol"); err == nil {
+		t.Error("Rollback to a missing version: got nil, want error")
+	}
+
+	if err := ps.Rename("tags", "post tags"); err != nil {
+		t.Fatal(err)
+	}
+	if revs, err := ps.Versions("tags"); err != nil || len(revs) != 0 {
+		t.Errorf("Versions of the old name: got %d, %v, want none", len(revs), err)
+	}
+	if revs, err := ps.Versions("post tags"); err != nil || len(revs) != 4 {
+		t.Fatalf("Versions of the new name: got %d, %v, want 4", len(revs), err)
+	}
+	if err := ps.Rollback("post tags", 2, "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := ps.Get("post tags"); err != nil || p.GetName() != "post tags" || p.GetVersion() != 5 {
+		t.Errorf("Get after Rollback past the rename: got %v, %v, want version 5 named post tags", p, err)
+	}
+	if ps.Has("tags") {
+		t.Error("Rollback past the rename restored the old name")
+	}
+}
+
+// failingBackend fails to set keys under prefix, once failing is set.
+type failingBackend struct {
+	eridanus.StorageBackend
+	prefix  string
+	failing bool
+}
+
+func (be *failingBackend) Set(key string, r io.Reader) error {
+	if be.failing && strings.HasPrefix(key, be.prefix) {
+		return fmt.Errorf("failing set of %s", key)
+	}
+	return be.StorageBackend.Set(key, r)
+}
+
+func TestPutFailure(t *testing.T) {
+	for i, ns := range []string{"classes/", "parsers/"} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "eridanus")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			be := &failingBackend{StorageBackend: diskv.NewBackend(dir), prefix: ns}
+			defer be.Close()
+			s := NewStorage(be)
+
+			put := func(host string) error {
+				if ns == "classes/" {
+					return s.ClassesStorage().Put(&eridanus.URLClass{Name: "post", Domain: host})
+				}
+				return s.ParsersStorage().Put(&eridanus.Parser{Name: "post", Urls: []string{"https://" + host + "/post/1"}})
+			}
+			versions := func() ([]*eridanus.Revision, error) {
+				if ns == "classes/" {
+					return s.ClassesStorage().Versions("post")
+				}
+				return s.ParsersStorage().Versions("post")
+			}
+
+			if err := put("example.com"); err != nil {
+				t.Fatal(err)
+			}
+			be.failing = true
+			if err := put("example.net"); err == nil {
+				t.Fatal("Put with a failing backend: got nil, want error")
+			}
+			if revs, err := versions(); err != nil || len(revs) != 1 {
+				t.Errorf("Versions after a failed Put: got %d, %v, want 1", len(revs), err)
+			}
+			if err := put("example.com"); err == nil {
+				t.Fatal("Put of the unchanged definition with a failing backend: got nil, want error")
+			}
+			if revs, err := versions(); err != nil || len(revs) != 1 {
+				t.Errorf("Versions after a failed unchanged Put: got %d, %v, want 1", len(revs), err)
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	s := newTestStorage(t)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 100)
+	for _, item := range []struct {
+		content string
+		tags    eridanus.Tags
+	}{
+		{png, eridanus.Tags{"creator:calm", "cat"}},
+		{"plain text", eridanus.Tags{"creator:calm", "rating:explicit"}},
+		{"<html></html>", eridanus.Tags{"creator:other"}},
+	} {
+		idHash, err := s.ContentStorage().Put(strings.NewReader(item.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.TagStorage().Put(idHash, item.tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pngHash, err := eridanus.GenerateIDHash(strings.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"creator:calm", 2},
+		{"creator:* -rating:explicit", 2},
+		{"system:size>50 system:imported<1h", 1},
+		{"system:size>50 system:imported>1h", 0},
+		{"creator:calm system:limit=1", 1},
+	} {
+		q, err := eridanus.ParseTagQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.TagStorage().Find(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != test.want {
+			t.Errorf("Find(%q): got %v, want %d items", test.query, got, test.want)
+		}
+	}
+
+	q, err := eridanus.ParseTagQuery("system:mime=image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.TagStorage().Find(q); err != nil || fmt.Sprint(got) != fmt.Sprint(eridanus.IDHashes{pngHash}) {
+		t.Errorf("Find(%q): got %v (%v), want %v", q, got, err, pngHash)
+	}
+}
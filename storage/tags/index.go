@@ -0,0 +1,494 @@
+package tags
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/scytrin/eridanus"
+	"github.com/sirupsen/logrus"
+)
+
+// The index is kept as shards, each listing the items whose hashes share a
+// prefix, at tagindex/<hash prefix>, so that loading it reads a bounded number
+// of files however many tags there are. A shard holds a line for each item,
+// of its hash and quoted tags separated by tabs. An update in progress is
+// marked at tagindex/.pending/<hash>, and a complete index at tagindex/.built,
+// holding the format of the shards. The keys of a service's index are under
+// its prefix.
+const (
+	indexNamespace = "tagindex"
+	indexBuiltKey  = indexNamespace + "/.built"
+	indexPending   = indexNamespace + "/.pending"
+	indexFormat    = "2" // shards by item hash prefix, previously by tag
+	shardPrefixLen = 2
+)
+
+// tagIndex maps lowercased tags to the sorted hashes of the items with them,
+// and items to their tags.
+type tagIndex struct {
+	postings   map[eridanus.Tag][]eridanus.IDHash
+	namespaces map[string]map[eridanus.Tag]bool // the tags of each namespace
+	items      map[eridanus.IDHash]eridanus.Tags
+	all        []eridanus.IDHash // sorted hashes of the items
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		postings:   make(map[eridanus.Tag][]eridanus.IDHash),
+		namespaces: make(map[string]map[eridanus.Tag]bool),
+		items:      make(map[eridanus.IDHash]eridanus.Tags),
+	}
+}
+
+func (ix *tagIndex) addTag(t eridanus.Tag) {
+	ns := t.Namespace()
+	if ix.namespaces[ns] == nil {
+		ix.namespaces[ns] = make(map[eridanus.Tag]bool)
+	}
+	ix.namespaces[ns][t] = true
+}
+
+func (ix *tagIndex) removeTag(t eridanus.Tag) {
+	ns := t.Namespace()
+	delete(ix.namespaces[ns], t)
+	if len(ix.namespaces[ns]) == 0 {
+		delete(ix.namespaces, ns)
+	}
+}
+
+// matching calls f with each tag matching the lowercased pattern, only
+// considering the tags of the pattern's namespace when it names one.
+func (ix *tagIndex) matching(pattern string, f func(eridanus.Tag, []eridanus.IDHash)) {
+	if i := strings.IndexByte(pattern, ':'); i >= 0 && !strings.Contains(pattern[:i], "*") {
+		for t := range ix.namespaces[pattern[:i]] {
+			if eridanus.MatchTag(pattern, t) {
+				f(t, ix.postings[t])
+			}
+		}
+		return
+	}
+	for t, ps := range ix.postings {
+		if eridanus.MatchTag(pattern, t) {
+			f(t, ps)
+		}
+	}
+}
+
+func normalize(tags eridanus.Tags) eridanus.Tags {
+	var out eridanus.Tags
+	for _, t := range tags {
+		if t != "" {
+			out = append(out, eridanus.Tag(strings.ToLower(string(t))))
+		}
+	}
+	return out.OmitDuplicates()
+}
+
+// set replaces the item's tags, returning the tags whose postings changed.
+func (ix *tagIndex) set(idHash eridanus.IDHash, tags eridanus.Tags) eridanus.Tags {
+	tags = normalize(tags)
+	old := make(map[eridanus.Tag]bool)
+	for _, t := range ix.items[idHash] {
+		old[t] = true
+	}
+	var changed eridanus.Tags
+	for _, t := range tags {
+		if old[t] {
+			delete(old, t)
+			continue
+		}
+		if len(ix.postings[t]) == 0 {
+			ix.addTag(t)
+		}
+		ix.postings[t] = insertHash(ix.postings[t], idHash)
+		changed = append(changed, t)
+	}
+	for t := range old {
+		if ps := removeHash(ix.postings[t], idHash); len(ps) > 0 {
+			ix.postings[t] = ps
+		} else {
+			delete(ix.postings, t)
+			ix.removeTag(t)
+		}
+		changed = append(changed, t)
+	}
+	_, had := ix.items[idHash]
+	switch {
+	case len(tags) > 0:
+		if !had {
+			ix.all = insertHash(ix.all, idHash)
+		}
+		ix.items[idHash] = tags
+	case had:
+		ix.all = removeHash(ix.all, idHash)
+		delete(ix.items, idHash)
+	}
+	return changed
+}
+
+func insertHash(hs []eridanus.IDHash, h eridanus.IDHash) []eridanus.IDHash {
+	i := sort.Search(len(hs), func(i int) bool { return hs[i] >= h })
+	if i < len(hs) && hs[i] == h {
+		return hs
+	}
+	hs = append(hs, "")
+	copy(hs[i+1:], hs[i:])
+	hs[i] = h
+	return hs
+}
+
+func removeHash(hs []eridanus.IDHash, h eridanus.IDHash) []eridanus.IDHash {
+	i := sort.Search(len(hs), func(i int) bool { return hs[i] >= h })
+	if i == len(hs) || hs[i] != h {
+		return hs
+	}
+	return append(hs[:i], hs[i+1:]...)
+}
+
+// candidates returns the sorted hashes of items that may match the
+// expression, and false if the index does not narrow them.
+func (ix *tagIndex) candidates(e eridanus.TagExpr) ([]eridanus.IDHash, bool) {
+	switch e := e.(type) {
+	case eridanus.TagMatch:
+		pattern := strings.ToLower(string(e))
+		if !strings.Contains(pattern, "*") {
+			if eridanus.MatchTag(pattern, eridanus.Tag(pattern)) {
+				return ix.postings[eridanus.Tag(pattern)], true
+			}
+			return nil, true
+		}
+		var out []eridanus.IDHash
+		ix.matching(pattern, func(_ eridanus.Tag, ps []eridanus.IDHash) {
+			out = append(out, ps...)
+		})
+		sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+		return dedupe(out), true
+	case eridanus.TagAnd:
+		var out []eridanus.IDHash
+		var narrowed bool
+		for _, x := range e {
+			if hs, ok := ix.candidates(x); ok {
+				if narrowed {
+					out = intersect(out, hs)
+				} else {
+					out, narrowed = hs, true
+				}
+			}
+		}
+		return out, narrowed
+	case eridanus.TagOr:
+		var out []eridanus.IDHash
+		for _, x := range e {
+			hs, ok := ix.candidates(x)
+			if !ok {
+				return nil, false
+			}
+			out = union(out, hs)
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func union(a, b []eridanus.IDHash) []eridanus.IDHash {
+	out := make([]eridanus.IDHash, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	out = append(out, a[i:]...)
+	return append(out, b[j:]...)
+}
+
+// dedupe removes repeated hashes from a sorted slice.
+func dedupe(hs []eridanus.IDHash) []eridanus.IDHash {
+	var out []eridanus.IDHash
+	for i, h := range hs {
+		if i == 0 || h != hs[i-1] {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func intersect(a, b []eridanus.IDHash) []eridanus.IDHash {
+	var out []eridanus.IDHash
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	return out
+}
+
+// find selects the matching items, narrowing them by the index before
+// evaluating the query on each.
+func (ix *tagIndex) find(q *eridanus.TagQuery, info func(eridanus.IDHash) (*eridanus.ContentInfo, error)) (eridanus.IDHashes, error) {
+	var hs []eridanus.IDHash
+	var ok bool
+	if q != nil && q.Expr != nil {
+		hs, ok = ix.candidates(q.Expr)
+	}
+	if !ok {
+		hs = ix.all
+	}
+
+	needsInfo := q.NeedsInfo()
+	block := make([]eridanus.TagItem, len(hs))
+	items := make([]*eridanus.TagItem, len(hs))
+	for i, h := range hs {
+		item := &block[i]
+		item.Hash, item.Tags = h, ix.items[h]
+		if needsInfo {
+			var err error
+			if item.Info, err = info(h); err != nil {
+				return nil, err
+			}
+		}
+		items[i] = item
+	}
+	return q.Select(items), nil
+}
+
+func shardKey(prefix string) string {
+	return fmt.Sprintf("%s/%s", indexNamespace, prefix)
+}
+
+func hashPrefix(h eridanus.IDHash) string {
+	if len(h) < shardPrefixLen {
+		return string(h)
+	}
+	return string(h[:shardPrefixLen])
+}
+
+// writeShard persists the tags of the items sharing the hash's prefix.
+func (s *tagStorage) writeShard(h eridanus.IDHash) error {
+	prefix := hashPrefix(h)
+	key := s.prefix + shardKey(prefix)
+	all := s.ix.all
+	i := sort.Search(len(all), func(i int) bool { return hashPrefix(all[i]) >= prefix })
+	var b strings.Builder
+	var n int
+	for ; i < len(all) && hashPrefix(all[i]) == prefix; i++ {
+		b.WriteString(string(all[i]))
+		for _, t := range s.ix.items[all[i]] {
+			b.WriteByte('\t')
+			b.WriteString(strconv.Quote(string(t)))
+		}
+		b.WriteByte('\n')
+		n++
+	}
+	if n == 0 {
+		if s.be.Has(key) {
+			return s.be.Delete(key)
+		}
+		return nil
+	}
+	return s.be.Set(key, strings.NewReader(b.String()))
+}
+
+// readShard adds the items of the shard to the index.
+func (s *tagStorage) readShard(ix *tagIndex, key string) error {
+	r, err := s.be.Get(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		h := eridanus.IDHash(fields[0])
+		tags := make(eridanus.Tags, 0, len(fields)-1)
+		for _, f := range fields[1:] {
+			tag, err := strconv.Unquote(f)
+			if err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+			t := eridanus.Tag(tag)
+			tags = append(tags, t)
+			ix.postings[t] = append(ix.postings[t], h)
+		}
+		ix.items[h] = tags
+		ix.all = append(ix.all, h)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	return nil
+}
+
+// indexKeys lists the keys of the persisted index, without walking the rest
+// of the store.
+func (s *tagStorage) indexKeys() ([]string, error) {
+	return s.be.Keys(s.prefix + indexNamespace + "/")
+}
+
+// loadIndex reads the persisted index, building it if absent or in an older
+// format and completing any interrupted updates. It must be called with s.m
+// held.
+func (s *tagStorage) loadIndex() error {
+	if s.ix != nil {
+		return nil
+	}
+	if format, err := s.indexFormat(); err != nil || format != indexFormat {
+		logrus.Info("building tag index")
+		return s.rebuildIndex()
+	}
+
+	keys, err := s.indexKeys()
+	if err != nil {
+		return err
+	}
+	ix := newTagIndex()
+	var pending []eridanus.IDHash
+	for _, k := range keys {
+		parts := strings.Split(strings.TrimPrefix(k, s.prefix+indexNamespace+"/"), "/")
+		switch {
+		case len(parts) == 2 && parts[0] == ".pending":
+			pending = append(pending, eridanus.IDHash(parts[1]))
+			continue
+		case len(parts) != 1 || strings.HasPrefix(parts[0], "."):
+			continue
+		}
+		if err := s.readShard(ix, k); err != nil {
+			return err
+		}
+	}
+	for t, ps := range ix.postings {
+		sort.Slice(ps, func(i, j int) bool { return ps[i] < ps[j] })
+		ix.postings[t] = ps
+		ix.addTag(t)
+	}
+	sort.Slice(ix.all, func(i, j int) bool { return ix.all[i] < ix.all[j] })
+	s.ix = ix
+
+	for _, h := range pending {
+		tags, err := s.get(h)
+		if err != nil {
+			return err
+		}
+		if err := s.index(h, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexFormat provides the format of the persisted index, an error if there
+// is none.
+func (s *tagStorage) indexFormat() (string, error) {
+	r, err := s.be.Get(s.prefix + indexBuiltKey)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+// index updates the item's postings and persists the changed shards, clearing
+// the item's pending mark. It must be called with s.m held.
+func (s *tagStorage) index(h eridanus.IDHash, tags eridanus.Tags) error {
+	if len(s.ix.set(h, tags)) > 0 {
+		if err := s.writeShard(h); err != nil {
+			return err
+		}
+	}
+	if key := fmt.Sprintf("%s%s/%s", s.prefix, indexPending, h); s.be.Has(key) {
+		return s.be.Delete(key)
+	}
+	return nil
+}
+
+// rebuildIndex builds the index from the stored tags, replacing any persisted
+// index. It must be called with s.m held.
+func (s *tagStorage) rebuildIndex() error {
+	keys, err := s.indexKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.be.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	ix := newTagIndex()
+	hashes, err := s.hashes()
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		tags, err := s.get(h)
+		if err != nil {
+			return err
+		}
+		ix.set(h, tags)
+	}
+	s.ix = ix
+	return s.writeIndex()
+}
+
+// writeIndex persists every shard of the index and marks it complete. It must
+// be called with s.m held.
+func (s *tagStorage) writeIndex() error {
+	for i, h := range s.ix.all {
+		if i > 0 && hashPrefix(s.ix.all[i-1]) == hashPrefix(h) {
+			continue
+		}
+		if err := s.writeShard(h); err != nil {
+			return err
+		}
+	}
+	return s.be.Set(s.prefix+indexBuiltKey, strings.NewReader(indexFormat))
+}
+
+// RebuildIndex rebuilds the tag index from the stored tags.
+func (s *tagStorage) RebuildIndex() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ix = nil
+	return s.rebuildIndex()
+}
+
+// Counts provides the number of items with each tag matching the pattern, in
+// which * matches any run of characters. Tags are lowercased, and those in
+// reserved namespaces only counted when the pattern names their namespace.
+func (s *tagStorage) Counts(pattern string) (map[eridanus.Tag]int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	pattern = strings.ToLower(pattern)
+	if pattern == "" {
+		pattern = "*"
+	}
+	counts := make(map[eridanus.Tag]int)
+	s.ix.matching(pattern, func(t eridanus.Tag, ps []eridanus.IDHash) {
+		counts[t] = len(ps)
+	})
+	return counts, nil
+}
@@ -0,0 +1,206 @@
+package tags
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/backend/diskv"
+	"github.com/scytrin/eridanus/storage/content"
+)
+
+func newTestBackend(t *testing.T) eridanus.StorageBackend {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	be := diskv.NewBackend(dir)
+	t.Cleanup(func() { be.Close() })
+	return be
+}
+
+func find(t *testing.T, ts eridanus.TagStorage, query string) string {
+	t.Helper()
+	q, err := eridanus.ParseTagQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ts.Find(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprint(got)
+}
+
+func TestIndex(t *testing.T) {
+	be := newTestBackend(t)
+	// an existing store, tagged before the index
+	if err := be.Set(metadataNamespace+"/aa", strings.NewReader("creator:calm,Cat")); err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTagStorage(be, content.NewContentStorage(be))
+	if got, want := find(t, ts, "cat"), "[aa]"; got != want {
+		t.Errorf("existing store: got %v, want %v", got, want)
+	}
+
+	for h, tags := range map[eridanus.IDHash]eridanus.Tags{
+		"ab": {"creator:calm", "dog"},
+		"bb": {"creator:other", "cat", "multi\nline", "source:http://cat.example.com/"},
+	} {
+		if err := ts.Put(h, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Put("aa", eridanus.Tags{"creator:calm", "hat"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ query, want string }{
+		{"cat", "[bb]"},
+		{"creator:calm", "[aa ab]"},
+		{"creator:* -dog", "[aa bb]"},
+		{"hat OR dog", "[aa ab]"},
+		{`"multi` + "\n" + `line"`, "[bb]"},
+		{"*cat*", "[bb]"},
+		{"source:*cat*", "[bb]"},
+		{"*:http*", "[]"},
+	} {
+		if got := find(t, ts, test.query); got != test.want {
+			t.Errorf("Find(%q): got %v, want %v", test.query, got, test.want)
+		}
+	}
+	counts, err := ts.Counts("creator:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(counts), "map[creator:calm:2 creator:other:1]"; got != want {
+		t.Errorf("Counts: got %v, want %v", got, want)
+	}
+
+	// an update interrupted after storing the tags
+	if err := be.Set(indexPending+"/ab", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.Set(servicePrefix(eridanus.ServiceMyTags)+recordsNamespace+"/ab", strings.NewReader("tags:\n  - tag: cat\n")); err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTagStorage(be, content.NewContentStorage(be))
+	if got, want := find(t, ts, "cat"), "[ab bb]"; got != want {
+		t.Errorf("after interruption: got %v, want %v", got, want)
+	}
+	if got, want := find(t, ts, "dog"), "[]"; got != want {
+		t.Errorf("after interruption: got %v, want %v", got, want)
+	}
+	if be.Has(indexPending + "/ab") {
+		t.Error("pending mark not cleared")
+	}
+
+	// a lost shard
+	if err := be.Delete(shardKey("aa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.RebuildIndex(); err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTagStorage(be, content.NewContentStorage(be))
+	if got, want := find(t, ts, "hat"), "[aa]"; got != want {
+		t.Errorf("after rebuild: got %v, want %v", got, want)
+	}
+
+	// an index in the format sharded by tag
+	if err := be.Delete(shardKey("aa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.Set(indexBuiltKey, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTagStorage(be, content.NewContentStorage(be))
+	if got, want := find(t, ts, "hat"), "[aa]"; got != want {
+		t.Errorf("after upgrade: got %v, want %v", got, want)
+	}
+}
+
+var (
+	benchIndex     *tagIndex
+	benchIndexOnce sync.Once
+)
+
+// BenchmarkFind searches an index of a million items.
+func BenchmarkFind(b *testing.B) {
+	benchIndexOnce.Do(func() {
+		benchIndex = newTagIndex()
+		for i := 0; i < 1e6; i++ {
+			benchIndex.set(eridanus.IDHash(fmt.Sprintf("%064x", i)), eridanus.Tags{
+				eridanus.Tag(fmt.Sprintf("creator:c%d", i%1000)),
+				eridanus.Tag(fmt.Sprintf("tag%d", i%100)),
+				eridanus.Tag(fmt.Sprintf("rating:%d", i%3)),
+				eridanus.Tag(fmt.Sprintf("source:http://example.com/%d", i)),
+			})
+		}
+	})
+	for _, query := range []string{
+		"creator:c42",
+		"tag7 -rating:2",
+		"creator:c1 OR creator:c2 OR tag3",
+		"creator:c99* system:sort=-tags system:limit=50",
+		"-tag1 system:limit=100",
+		"-tag1",
+	} {
+		q, err := eridanus.ParseTagQuery(query)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(query, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := benchIndex.find(q, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLoadIndex loads the persisted index of a hundred thousand items
+// from a diskv store, as on startup.
+func BenchmarkLoadIndex(b *testing.B) {
+	dir, err := ioutil.TempDir("", "eridanus")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	be := diskv.NewBackend(dir)
+	defer be.Close()
+
+	s := NewTagStorage(be, content.NewContentStorage(be)).(*tagStorage)
+	s.ix = newTagIndex()
+	for i := 0; i < 1e5; i++ {
+		h, err := eridanus.GenerateIDHash(strings.NewReader(fmt.Sprint(i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		s.ix.set(h, eridanus.Tags{
+			eridanus.Tag(fmt.Sprintf("creator:c%d", i%1000)),
+			eridanus.Tag(fmt.Sprintf("tag%d", i%100)),
+			eridanus.Tag(fmt.Sprintf("rating:%d", i%3)),
+			eridanus.Tag(fmt.Sprintf("source:http://example.com/%d", i)),
+		})
+	}
+	if err := s.writeIndex(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := NewTagStorage(be, content.NewContentStorage(be)).(*tagStorage)
+		if err := s.loadIndex(); err != nil {
+			b.Fatal(err)
+		}
+		if len(s.ix.all) != 1e5 {
+			b.Fatalf("loaded %d items, want %d", len(s.ix.all), int(1e5))
+		}
+	}
+}
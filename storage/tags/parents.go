@@ -0,0 +1,205 @@
+package tags
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
+)
+
+// Implied tags are not stored with items, queries instead matching the tags
+// implying those asked for. The closure of the relations is cached as the
+// tags implying each parent, and recomputed for the parents an edit affects.
+const parentsKey = "tagparents/table"
+
+// parents provides the parent table, loading it and computing its closure on
+// first use. It must be called with s.m held.
+func (s *tagStorage) parents() (*eridanus.TagParents, error) {
+	if s.par != nil {
+		return s.par, nil
+	}
+	par := new(eridanus.TagParents)
+	rc, err := s.be.Get(parentsKey)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		defer rc.Close()
+		if err := yaml.NewDecoder(rc).Decode(par); err != nil {
+			return nil, err
+		}
+	}
+	s.par = par
+	s.implying = make(map[eridanus.Tag]eridanus.Tags)
+	var all eridanus.Tags
+	for _, ps := range par.GetParents() {
+		for _, p := range ps.GetTags() {
+			all = append(all, eridanus.Tag(strings.ToLower(p)))
+		}
+	}
+	s.recompute(all.OmitDuplicates())
+	return par, nil
+}
+
+// recompute updates the cached closure for the parent tags.
+func (s *tagStorage) recompute(parents eridanus.Tags) {
+	children := make(map[eridanus.Tag]eridanus.Tags)
+	for c, ps := range s.par.GetParents() {
+		for _, p := range ps.GetTags() {
+			p := eridanus.Tag(strings.ToLower(p))
+			children[p] = append(children[p], eridanus.Tag(c))
+		}
+	}
+	for _, p := range parents {
+		seen := make(map[eridanus.Tag]bool)
+		var visit func(eridanus.Tag)
+		visit = func(t eridanus.Tag) {
+			for _, c := range children[t] {
+				if !seen[c] {
+					seen[c] = true
+					visit(c)
+				}
+			}
+		}
+		visit(p)
+		if len(seen) == 0 {
+			delete(s.implying, p)
+			continue
+		}
+		var implying eridanus.Tags
+		for c := range seen {
+			implying = append(implying, c)
+		}
+		sort.Slice(implying, func(i, j int) bool { return implying[i] < implying[j] })
+		s.implying[p] = implying
+	}
+}
+
+// setParent adds or removes the relation, persisting the table and updating
+// the closure. It must be called with s.m held.
+func (s *tagStorage) setParent(child, parent eridanus.Tag, add bool) error {
+	par, err := s.parents()
+	if err != nil {
+		return err
+	}
+	c := strings.ToLower(string(child))
+	p := eridanus.Tag(strings.ToLower(string(parent)))
+	par = proto.Clone(par).(*eridanus.TagParents)
+	if par.Parents == nil {
+		par.Parents = make(map[string]*eridanus.TagParents_Tags)
+	}
+	var ps []string
+	for _, t := range par.Parents[c].GetTags() {
+		if strings.ToLower(t) != string(p) {
+			ps = append(ps, t)
+		}
+	}
+	if add {
+		ps = append(ps, string(parent))
+	}
+	if len(ps) > 0 {
+		par.Parents[c] = &eridanus.TagParents_Tags{Tags: ps}
+	} else {
+		delete(par.Parents, c)
+	}
+	if err := par.Check(); err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := yaml.NewEncoder(buf).Encode(par); err != nil {
+		return err
+	}
+	if err := s.be.Set(parentsKey, buf); err != nil {
+		return err
+	}
+	s.par = par
+	s.recompute(append(par.Implied(p), p))
+	return nil
+}
+
+// Parents provides the table of tags implying others.
+func (s *tagStorage) Parents() (*eridanus.TagParents, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	par, err := s.parents()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(par).(*eridanus.TagParents), nil
+}
+
+// AddParent makes the child tag imply the parent tag.
+func (s *tagStorage) AddParent(child, parent eridanus.Tag) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if strings.EqualFold(string(child), string(parent)) {
+		return fmt.Errorf("parent cycle: %s implies itself", child)
+	}
+	return s.setParent(child, parent, true)
+}
+
+// RemoveParent makes the child tag no longer imply the parent tag directly.
+func (s *tagStorage) RemoveParent(child, parent eridanus.Tag) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.setParent(child, parent, false)
+}
+
+// expand makes each tag in the expression also match its siblings, the tags
+// implying it, and their siblings. It must be called with s.m held.
+func (s *tagStorage) expand(e eridanus.TagExpr, sib *eridanus.TagSiblings) eridanus.TagExpr {
+	switch e := e.(type) {
+	case eridanus.TagMatch:
+		pattern := strings.ToLower(string(e))
+		var tags eridanus.Tags
+		if strings.Contains(pattern, "*") {
+			for p, implying := range s.implying {
+				if eridanus.MatchTag(pattern, p) {
+					tags = append(tags, implying...)
+				}
+			}
+		} else {
+			for _, t := range sib.Group(eridanus.Tag(e)) {
+				tags = append(tags, t)
+				tags = append(tags, s.implying[t]...)
+			}
+		}
+		var group eridanus.Tags
+		for _, t := range tags {
+			group = append(group, sib.Group(t)...)
+		}
+		sort.Slice(group, func(i, j int) bool { return group[i] < group[j] })
+		or := eridanus.TagOr{e}
+		for _, t := range group.OmitDuplicates() {
+			if string(t) != pattern {
+				or = append(or, eridanus.TagMatch(t))
+			}
+		}
+		if len(or) == 1 {
+			return e
+		}
+		return or
+	case eridanus.TagAnd:
+		and := make(eridanus.TagAnd, len(e))
+		for i, x := range e {
+			and[i] = s.expand(x, sib)
+		}
+		return and
+	case eridanus.TagOr:
+		or := make(eridanus.TagOr, len(e))
+		for i, x := range e {
+			or[i] = s.expand(x, sib)
+		}
+		return or
+	case eridanus.TagNot:
+		return eridanus.TagNot{Expr: s.expand(e.Expr, sib)}
+	}
+	return e
+}
@@ -0,0 +1,68 @@
+package tags
+
+import (
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/content"
+)
+
+func TestParents(t *testing.T) {
+	be := newTestBackend(t)
+	ts := NewTagStorage(be, content.NewContentStorage(be))
+	for h, tags := range map[eridanus.IDHash]eridanus.Tags{
+		"aa": {"character:samus"},
+		"ab": {"character:Ridley", "series:metroid"},
+		"bb": {"zero suit"},
+		"bc": {"character:link"},
+	} {
+		if err := ts.Put(h, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rel := range [][2]eridanus.Tag{
+		{"character:samus", "series:metroid"},
+		{"character:ridley", "series:metroid"},
+		{"series:metroid", "genre:scifi"},
+		{"character:link", "series:zelda"},
+	} {
+		if err := ts.AddParent(rel[0], rel[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.AddParent("genre:scifi", "character:samus"); err == nil {
+		t.Error("cycle allowed")
+	}
+	if err := ts.SetSibling("samus", "character:samus"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.SetSibling("zero suit", "samus"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct{ query, want string }{
+		{"series:metroid", "[aa ab bb]"},
+		{"genre:scifi", "[aa ab bb]"},
+		{"series:*", "[aa ab bb bc]"},
+		{"genre:scifi -character:ridley", "[aa bb]"},
+		{"character:samus", "[aa bb]"},
+	} {
+		if got := find(t, ts, test.query); got != test.want {
+			t.Errorf("Find(%q): got %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	if err := ts.RemoveParent("series:metroid", "genre:scifi"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := find(t, ts, "genre:scifi"), "[]"; got != want {
+		t.Errorf("after removal: got %v, want %v", got, want)
+	}
+	if err := ts.RemoveParent("character:samus", "series:metroid"); err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTagStorage(be, content.NewContentStorage(be))
+	if got, want := find(t, ts, "series:metroid"), "[ab]"; got != want {
+		t.Errorf("after reload: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,189 @@
+package tags
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
+)
+
+// The tags and index of each service are kept under tagservices/<escaped
+// name>/, and the names of the services with tags at tagservices/.names.
+const (
+	servicesNamespace = "tagservices"
+	serviceNamesKey   = servicesNamespace + "/.names"
+)
+
+func servicePrefix(name string) string {
+	return fmt.Sprintf("%s/%s/", servicesNamespace, url.PathEscape(name))
+}
+
+// serviceFor provides the service receiving the record when added through the
+// combined view. Reserved tags, such as source: and phash:, go to the system
+// service whatever their source, so that deleting another service keeps them.
+func serviceFor(r *eridanus.TagRecord) string {
+	if eridanus.Tag(r.GetTag()).Reserved() {
+		return eridanus.ServiceSystem
+	}
+	switch r.GetSource() {
+	case eridanus.TagRecord_PARSER, eridanus.TagRecord_URL:
+		return eridanus.ServiceDownloader
+	case eridanus.TagRecord_CONTENT:
+		return eridanus.ServiceSystem
+	}
+	return eridanus.ServiceMyTags
+}
+
+// view provides the view of the named service, the combined view for an
+// empty name. It must be called with s.m held.
+func (s *tagStorage) view(name string) *tagStorage {
+	if name == "" {
+		return s.all
+	}
+	v, ok := s.services[name]
+	if !ok {
+		v = &tagStorage{shared: s.shared, be: s.be, ds: s.ds, service: name, prefix: servicePrefix(name)}
+		s.services[name] = v
+	}
+	return v
+}
+
+// serviceNames provides the names of the services with tags, loading them on
+// first use. It must be called with s.m held.
+func (s *tagStorage) serviceNames() ([]string, error) {
+	if s.names != nil {
+		return s.names, nil
+	}
+	names := []string{}
+	rc, err := s.be.Get(serviceNamesKey)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		defer rc.Close()
+		if err := yaml.NewDecoder(rc).Decode(&names); err != nil {
+			return nil, err
+		}
+	}
+	s.names = names
+	return names, nil
+}
+
+func (s *tagStorage) setServiceNames(names []string) error {
+	sort.Strings(names)
+	buf := new(bytes.Buffer)
+	if err := yaml.NewEncoder(buf).Encode(names); err != nil {
+		return err
+	}
+	if err := s.be.Set(serviceNamesKey, buf); err != nil {
+		return err
+	}
+	s.names = names
+	return nil
+}
+
+// register records that the service has tags. It must be called with s.m
+// held.
+func (s *tagStorage) register() error {
+	names, err := s.serviceNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == s.service {
+			return nil
+		}
+	}
+	return s.setServiceNames(append(append([]string(nil), names...), s.service))
+}
+
+// Service provides the view of the named service's tags.
+func (s *tagStorage) Service(name string) (eridanus.TagStorage, error) {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid tag service name %q", name)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.view(name), nil
+}
+
+// Services provides the names of the default services and those with tags.
+func (s *tagStorage) Services() ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	names, err := s.serviceNames()
+	if err != nil {
+		return nil, err
+	}
+	out := []string{eridanus.ServiceMyTags, eridanus.ServiceDownloader, eridanus.ServiceSystem}
+	for _, name := range names {
+		if name != eridanus.ServiceMyTags && name != eridanus.ServiceDownloader && name != eridanus.ServiceSystem {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
+
+// DeleteService deletes the tags of the named service, updating the combined
+// index for the items it had tagged.
+func (s *tagStorage) DeleteService(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid tag service name %q", name)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	v := s.view(name)
+	hashes, err := v.hashes()
+	if err != nil {
+		return err
+	}
+	if err := s.all.loadIndex(); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if err := s.all.markPending(h); err != nil {
+			return err
+		}
+	}
+
+	keys, err := s.be.Keys(v.prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := s.be.Delete(k); err != nil {
+			return err
+		}
+	}
+	v.ix = nil
+	names, err := s.serviceNames()
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	if err := s.setServiceNames(kept); err != nil {
+		return err
+	}
+
+	for _, h := range hashes {
+		tags, err := s.all.get(h)
+		if err != nil {
+			return err
+		}
+		if err := s.all.index(h, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package tags
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/content"
+)
+
+func TestServices(t *testing.T) {
+	be := newTestBackend(t)
+	ts := NewTagStorage(be, content.NewContentStorage(be))
+	dl, err := ts.Service(eridanus.ServiceDownloader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dl.Add("aa", eridanus.Tags{"cat", "creator:calm"}.Records(eridanus.TagRecord_PARSER, "p", "")...); err != nil {
+		t.Fatal(err)
+	}
+	if err := dl.Add("ab", eridanus.Tags{"dog"}.Records(eridanus.TagRecord_PARSER, "p", "")...); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Put("aa", eridanus.Tags{"favourite"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Add("ab", &eridanus.TagRecord{Tag: "phash:8000", Source: eridanus.TagRecord_CONTENT}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Add("aa", eridanus.Tags{"creator:calm", "source:example.com"}.Records(eridanus.TagRecord_URL, "", "https://example.com/post/1")...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		service, query, want string
+	}{
+		{"", "cat favourite", "[aa]"},
+		{"", "system:phash", "[ab]"},
+		{eridanus.ServiceDownloader, "cat favourite", "[]"},
+		{eridanus.ServiceDownloader, "creator:*", "[aa]"},
+		{eridanus.ServiceMyTags, "favourite", "[aa]"},
+		{eridanus.ServiceSystem, "phash:*", "[ab]"},
+		{eridanus.ServiceSystem, "source:*", "[aa]"},
+		{eridanus.ServiceDownloader, "source:*", "[]"},
+	} {
+		v := ts
+		if test.service != "" {
+			if v, err = ts.Service(test.service); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := find(t, v, test.query); got != test.want {
+			t.Errorf("%s: Find(%q): got %v, want %v", test.service, test.query, got, test.want)
+		}
+	}
+	got, err := ts.Get("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprintf("%q", got.ToSlice()), `["cat" "creator:calm" "favourite" "source:example.com"]`; got != want {
+		t.Errorf("Get: got %v, want %v", got, want)
+	}
+
+	if err := ts.DeleteService(eridanus.ServiceDownloader); err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTagStorage(be, content.NewContentStorage(be))
+	for _, test := range []struct{ query, want string }{
+		{"cat", "[]"},
+		{"favourite", "[aa]"},
+		{"system:phash", "[ab]"},
+		{"source:*", "[aa]"},
+	} {
+		if got := find(t, ts, test.query); got != test.want {
+			t.Errorf("after deletion: Find(%q): got %v, want %v", test.query, got, test.want)
+		}
+	}
+	if got, err := ts.Get("aa"); err != nil || fmt.Sprint(got.ToSlice()) != "[favourite source:example.com]" {
+		t.Errorf("after deletion: Get: got %q, %v, want [favourite source:example.com]", got.ToSlice(), err)
+	}
+	names, err := ts.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(names), "[my tags downloader tags system]"; got != want {
+		t.Errorf("Services: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package tags
+
+import (
+	"bytes"
+	"os"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
+)
+
+const siblingsKey = "tagsiblings/table"
+
+// siblings provides the sibling table, loading it on first use. It must be
+// called with s.m held.
+func (s *tagStorage) siblings() (*eridanus.TagSiblings, error) {
+	if s.sib != nil {
+		return s.sib, nil
+	}
+	sib := new(eridanus.TagSiblings)
+	rc, err := s.be.Get(siblingsKey)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		defer rc.Close()
+		if err := yaml.NewDecoder(rc).Decode(sib); err != nil {
+			return nil, err
+		}
+	}
+	s.sib = sib
+	return sib, nil
+}
+
+// setSiblings persists the sibling table once checked for cycles. It must be
+// called with s.m held.
+func (s *tagStorage) setSiblings(sib *eridanus.TagSiblings) error {
+	if err := sib.Check(); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err := yaml.NewEncoder(buf).Encode(sib); err != nil {
+		return err
+	}
+	if err := s.be.Set(siblingsKey, buf); err != nil {
+		return err
+	}
+	s.sib = sib
+	return nil
+}
+
+// Siblings provides the sibling table.
+func (s *tagStorage) Siblings() (*eridanus.TagSiblings, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sib, err := s.siblings()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(sib).(*eridanus.TagSiblings), nil
+}
+
+// SetSibling makes the alias equivalent to the canonical tag, or no longer an
+// alias if the canonical tag is empty.
+func (s *tagStorage) SetSibling(alias, canonical eridanus.Tag) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sib, err := s.siblings()
+	if err != nil {
+		return err
+	}
+	sib = proto.Clone(sib).(*eridanus.TagSiblings)
+	if sib.Siblings == nil {
+		sib.Siblings = make(map[string]string)
+	}
+	key := strings.ToLower(string(alias))
+	if canonical == "" {
+		delete(sib.Siblings, key)
+	} else {
+		sib.Siblings[key] = string(canonical)
+	}
+	return s.setSiblings(sib)
+}
+
+// SetSiblingMode sets when tags are canonicalized. Tags already stored are
+// left as they are.
+func (s *tagStorage) SetSiblingMode(mode eridanus.TagSiblings_Mode) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	sib, err := s.siblings()
+	if err != nil {
+		return err
+	}
+	sib = proto.Clone(sib).(*eridanus.TagSiblings)
+	sib.Mode = mode
+	return s.setSiblings(sib)
+}
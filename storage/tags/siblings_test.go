@@ -0,0 +1,88 @@
+package tags
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/content"
+)
+
+func TestSiblings(t *testing.T) {
+	be := newTestBackend(t)
+	ts := NewTagStorage(be, content.NewContentStorage(be))
+	for h, tags := range map[eridanus.IDHash]eridanus.Tags{
+		"aa": {"cat"},
+		"ab": {"Cats", "hat"},
+		"bb": {"feline"},
+		"bc": {"dog"},
+	} {
+		if err := ts.Put(h, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for alias, canonical := range map[eridanus.Tag]eridanus.Tag{
+		"cats":   "cat",
+		"feline": "cats",
+	} {
+		if err := ts.SetSibling(alias, canonical); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.SetSibling("cat", "feline"); err == nil {
+		t.Error("cycle allowed")
+	}
+
+	for _, test := range []struct{ query, want string }{
+		{"cat", "[aa ab bb]"},
+		{"feline", "[aa ab bb]"},
+		{"-cats", "[bc]"},
+		{"cat hat", "[ab]"},
+	} {
+		if got := find(t, ts, test.query); got != test.want {
+			t.Errorf("Find(%q): got %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	for i, test := range []struct {
+		mode eridanus.TagSiblings_Mode
+		h    eridanus.IDHash
+		put  eridanus.Tags
+		want string
+	}{
+		{eridanus.TagSiblings_READ, "ab", nil, `["cat" "hat"]`},
+		{eridanus.TagSiblings_READ, "bb", nil, `["cat"]`},
+		{eridanus.TagSiblings_PUT, "bb", nil, `["feline"]`},
+		{eridanus.TagSiblings_PUT, "cc", eridanus.Tags{"feline", "cat", "hat"}, `["cat" "hat"]`},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if err := ts.SetSiblingMode(test.mode); err != nil {
+				t.Fatal(err)
+			}
+			if test.put != nil {
+				if err := ts.Put(test.h, test.put); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := ts.Get(test.h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%q", got.ToSlice()) != test.want {
+				t.Errorf("got %q, want %v", got.ToSlice(), test.want)
+			}
+		})
+	}
+
+	if err := ts.SetSibling("feline", ""); err != nil {
+		t.Fatal(err)
+	}
+	ts = NewTagStorage(be, content.NewContentStorage(be))
+	sib, err := ts.Siblings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(sib.GetMode(), sib.GetSiblings()), "PUT map[cats:cat]"; got != want {
+		t.Errorf("Siblings: got %v, want %v", got, want)
+	}
+}
@@ -1,41 +1,184 @@
 package tags
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/scytrin/eridanus"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	metadataNamespace = "metadata"
+	recordsNamespace  = "tagrecords"
+	metadataNamespace = "metadata" // comma separated tags, before records
 )
 
-type tagStorage struct{ be eridanus.StorageBackend }
+// shared is the state common to the views of a store's tags.
+type shared struct {
+	m        sync.Mutex
+	sib      *eridanus.TagSiblings          // loaded on first use
+	par      *eridanus.TagParents           // loaded on first use
+	implying map[eridanus.Tag]eridanus.Tags // lowercased parent to the tags implying it
+	names    []string                       // of the services with tags, loaded on first use
+	all      *tagStorage                    // the combined view
+	services map[string]*tagStorage
+}
+
+// tagStorage is a view of the tags of a service, or of every service
+// combined. The combined view also holds the tags stored before services,
+// until they are migrated.
+type tagStorage struct {
+	*shared
+	be eridanus.StorageBackend
+	ds eridanus.ContentStorage // for the content info of items found
 
-// NewTagStorage provides a new TagStorage.
-func NewTagStorage(be eridanus.StorageBackend) eridanus.TagStorage {
-	return &tagStorage{be}
+	service string    // empty for the combined view
+	prefix  string    // of the keys of the view's records and index
+	ix      *tagIndex // loaded on first use
+}
+
+// NewTagStorage provides a new TagStorage, viewing the tags of every service.
+func NewTagStorage(be eridanus.StorageBackend, ds eridanus.ContentStorage) eridanus.TagStorage {
+	s := &tagStorage{
+		shared: &shared{services: make(map[string]*tagStorage)},
+		be:     be,
+		ds:     ds,
+	}
+	s.all = s
+	return s
 }
 
 // Hashes returns a list of all tag item keys.
 func (s *tagStorage) Hashes() (eridanus.IDHashes, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.hashes()
+}
+
+func (s *tagStorage) hashes() (eridanus.IDHashes, error) {
+	prefixes := []string{s.prefix + recordsNamespace + "/"}
+	if s.service == "" {
+		names, err := s.serviceNames()
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, metadataNamespace+"/")
+		for _, name := range names {
+			prefixes = append(prefixes, servicePrefix(name)+recordsNamespace+"/")
+		}
+	}
 	var idHashes eridanus.IDHashes
-	keys, err := s.be.Keys(metadataNamespace)
+	seen := make(map[eridanus.IDHash]bool)
+	for _, p := range prefixes {
+		keys, err := s.be.Keys(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			h := eridanus.IDHash(strings.TrimPrefix(k, p))
+			if !seen[h] {
+				idHashes = append(idHashes, h)
+				seen[h] = true
+			}
+		}
+	}
+	return idHashes, nil
+}
+
+// GetTags provides a string slice of tags for the given hash, canonicalized
+// unless that was done when they were stored.
+func (s *tagStorage) Get(idHash eridanus.IDHash) (eridanus.Tags, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	tags, err := s.get(idHash)
 	if err != nil {
 		return nil, err
 	}
-	for _, k := range keys {
-		idHashes = append(idHashes, eridanus.IDHash(k))
+	sib, err := s.siblings()
+	if err != nil {
+		return nil, err
 	}
-	return idHashes, nil
+	if sib.GetMode() == eridanus.TagSiblings_READ {
+		tags = sib.Canonicalize(tags)
+	}
+	return tags, nil
 }
 
-// GetTags provides a string slice of tags for the given hash.
-func (s *tagStorage) Get(idHash eridanus.IDHash) (eridanus.Tags, error) {
+// get provides the tags for the given hash as stored.
+func (s *tagStorage) get(idHash eridanus.IDHash) (eridanus.Tags, error) {
+	rs, err := s.records(idHash)
+	if err != nil {
+		return nil, err
+	}
+	var tags eridanus.Tags
+	for _, r := range rs {
+		tags = append(tags, eridanus.Tag(r.GetTag()))
+	}
+	return tags.OmitDuplicates(), nil
+}
+
+// Records provides the tags for the given hash with where they came from,
+// and in the combined view the service holding them.
+func (s *tagStorage) Records(idHash eridanus.IDHash) ([]*eridanus.TagRecord, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.records(idHash)
+}
+
+func (s *tagStorage) records(idHash eridanus.IDHash) ([]*eridanus.TagRecord, error) {
+	if s.service != "" {
+		return s.read(fmt.Sprintf("%s%s/%s", s.prefix, recordsNamespace, idHash))
+	}
+	rs, err := s.legacy(idHash)
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.serviceNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		srs, err := s.view(name).records(idHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range srs {
+			r.Service = name
+			rs = append(rs, r)
+		}
+	}
+	return rs, nil
+}
+
+// read provides the records stored at the key, nil if there are none.
+func (s *tagStorage) read(key string) ([]*eridanus.TagRecord, error) {
+	rc, err := s.be.Get(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rc.Close()
+	var rs eridanus.TagRecords
+	if err := yaml.NewDecoder(rc).Decode(&rs); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return rs.GetTags(), nil
+}
+
+// legacy reads the records stored before services, or comma separated tags
+// as records of unknown source.
+func (s *tagStorage) legacy(idHash eridanus.IDHash) ([]*eridanus.TagRecord, error) {
+	if rPath := fmt.Sprintf("%s/%s", recordsNamespace, idHash); s.be.Has(rPath) {
+		return s.read(rPath)
+	}
 	mPath := fmt.Sprintf("%s/%s", metadataNamespace, idHash)
 	r, err := s.be.Get(mPath)
 	if err != nil {
@@ -44,47 +187,306 @@ func (s *tagStorage) Get(idHash eridanus.IDHash) (eridanus.Tags, error) {
 		}
 		return nil, err
 	}
+	defer r.Close()
 	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	tagStrs := strings.Split(string(b), ",")
 	var tags eridanus.Tags
-	for _, t := range tagStrs {
-		tags = append(tags, eridanus.Tag(t))
+	for _, t := range strings.Split(string(b), ",") {
+		if t != "" {
+			tags = append(tags, eridanus.Tag(t))
+		}
 	}
-	return tags.OmitDuplicates(), nil
+	return tags.Records(eridanus.TagRecord_UNKNOWN, "", ""), nil
 }
 
 // HasTags indicates if tags exist for the given hash.
 func (s *tagStorage) Has(idHash eridanus.IDHash) bool {
-	mPath := fmt.Sprintf("%s/%s", metadataNamespace, idHash)
-	return s.be.Has(mPath)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.service != "" {
+		return s.be.Has(fmt.Sprintf("%s%s/%s", s.prefix, recordsNamespace, idHash))
+	}
+	if s.be.Has(fmt.Sprintf("%s/%s", recordsNamespace, idHash)) ||
+		s.be.Has(fmt.Sprintf("%s/%s", metadataNamespace, idHash)) {
+		return true
+	}
+	names, err := s.serviceNames()
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if s.be.Has(fmt.Sprintf("%s%s/%s", servicePrefix(name), recordsNamespace, idHash)) {
+			return true
+		}
+	}
+	return false
 }
 
-// Put sets a string slice of tags for the given hash.
+// Put sets a string slice of tags for the given hash, updating the indexes.
+// Tags already set keep their records, others are recorded as manual. Tags
+// put through the combined view are those of the my tags service.
 func (s *tagStorage) Put(idHash eridanus.IDHash, newTags eridanus.Tags) error {
-	mPath := fmt.Sprintf("%s/%s", metadataNamespace, idHash)
-	tagStr := newTags.OmitDuplicates().String()
-	return s.be.Set(mPath, strings.NewReader(tagStr))
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.all.migrate(idHash); err != nil {
+		return err
+	}
+	if s.service == "" {
+		return s.view(eridanus.ServiceMyTags).replace(idHash, newTags)
+	}
+	return s.replace(idHash, newTags)
 }
 
-// Find searches through tags for matches.
-func (s *tagStorage) Find() (eridanus.IDHashes, error) {
-	var idHashes eridanus.IDHashes
-	keys, err := s.be.Keys(metadataNamespace)
+func (s *tagStorage) replace(idHash eridanus.IDHash, newTags eridanus.Tags) error {
+	sib, err := s.siblings()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if sib.GetMode() == eridanus.TagSiblings_PUT {
+		newTags = sib.Canonicalize(newTags)
+	}
+
+	old, err := s.records(idHash)
+	if err != nil {
+		return err
+	}
+	byTag := make(map[string]*eridanus.TagRecord)
+	for _, r := range old {
+		byTag[r.GetTag()] = r
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var rs []*eridanus.TagRecord
+	for _, t := range newTags.OmitDuplicates() {
+		r, ok := byTag[t.String()]
+		if !ok {
+			r = &eridanus.TagRecord{Tag: t.String(), Source: eridanus.TagRecord_MANUAL, Added: now}
+		}
+		rs = append(rs, r)
+	}
+	return s.put(idHash, rs)
+}
+
+// Add tags the given hash, keeping the records of tags it already has. Tags
+// added through the combined view go to the service for their source.
+func (s *tagStorage) Add(idHash eridanus.IDHash, records ...*eridanus.TagRecord) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.all.migrate(idHash); err != nil {
+		return err
+	}
+	if s.service != "" {
+		return s.add(idHash, records)
+	}
+	for _, name := range []string{eridanus.ServiceMyTags, eridanus.ServiceDownloader, eridanus.ServiceSystem} {
+		var rs []*eridanus.TagRecord
+		for _, r := range records {
+			if serviceFor(r) == name {
+				rs = append(rs, r)
+			}
+		}
+		if len(rs) > 0 {
+			if err := s.view(name).add(idHash, rs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *tagStorage) add(idHash eridanus.IDHash, records []*eridanus.TagRecord) error {
+	rs, added, err := s.merge(idHash, records)
+	if err != nil {
+		return err
+	}
+	if added == 0 && s.be.Has(fmt.Sprintf("%s%s/%s", s.prefix, recordsNamespace, idHash)) {
+		return nil
+	}
+	return s.put(idHash, rs)
+}
+
+// merge provides the service's records for the hash with those of tags it
+// does not have added, and the number added.
+func (s *tagStorage) merge(idHash eridanus.IDHash, records []*eridanus.TagRecord) ([]*eridanus.TagRecord, int, error) {
+	sib, err := s.siblings()
+	if err != nil {
+		return nil, 0, err
+	}
+	rs, err := s.records(idHash)
+	if err != nil {
+		return nil, 0, err
+	}
+	seen := make(map[string]bool)
+	for _, r := range rs {
+		seen[r.GetTag()] = true
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	var added int
+	for _, r := range records {
+		if seen[r.GetTag()] {
+			continue
+		}
+		r = proto.Clone(r).(*eridanus.TagRecord)
+		r.Service = ""
+		if sib.GetMode() == eridanus.TagSiblings_PUT {
+			r.Tag = sib.Canonical(eridanus.Tag(r.GetTag())).String()
+			if seen[r.GetTag()] {
+				continue
+			}
+		}
+		if r.GetAdded() == "" {
+			r.Added = now
+		}
+		rs = append(rs, r)
+		seen[r.GetTag()] = true
+		added++
+	}
+	return rs, added, nil
+}
+
+// put stores the service's records, updating the service's and the combined
+// indexes. Any records the hash had from before services must have been
+// migrated.
+func (s *tagStorage) put(idHash eridanus.IDHash, rs []*eridanus.TagRecord) error {
+	if err := s.all.loadIndex(); err != nil {
+		return err
+	}
+	if err := s.all.markPending(idHash); err != nil {
+		return err
+	}
+	if err := s.store(idHash, rs); err != nil {
+		return err
+	}
+	tags, err := s.all.get(idHash)
+	if err != nil {
+		return err
+	}
+	return s.all.index(idHash, tags)
+}
+
+// store writes the service's records and updates its index.
+func (s *tagStorage) store(idHash eridanus.IDHash, rs []*eridanus.TagRecord) error {
+	if err := s.register(); err != nil {
+		return err
+	}
+	if err := s.loadIndex(); err != nil {
+		return err
+	}
+	if err := s.markPending(idHash); err != nil {
+		return err
 	}
-	for _, mPath := range keys {
-		idHash := eridanus.IDHash(filepath.Base(mPath))
-		tags, err := s.Get(idHash)
+	rPath := fmt.Sprintf("%s%s/%s", s.prefix, recordsNamespace, idHash)
+	if len(rs) == 0 {
+		if s.be.Has(rPath) {
+			if err := s.be.Delete(rPath); err != nil {
+				return err
+			}
+		}
+	} else {
+		buf := new(bytes.Buffer)
+		if err := yaml.NewEncoder(buf).Encode(&eridanus.TagRecords{Tags: rs}); err != nil {
+			return err
+		}
+		if err := s.be.Set(rPath, buf); err != nil {
+			return err
+		}
+	}
+	var tags eridanus.Tags
+	for _, r := range rs {
+		tags = append(tags, eridanus.Tag(r.GetTag()))
+	}
+	return s.index(idHash, tags)
+}
+
+func (s *tagStorage) markPending(idHash eridanus.IDHash) error {
+	return s.be.Set(fmt.Sprintf("%s%s/%s", s.prefix, indexPending, idHash), strings.NewReader(""))
+}
+
+// migrate moves the records the hash had from before services to the
+// services for their sources. It must be called on the combined view.
+func (s *tagStorage) migrate(idHash eridanus.IDHash) error {
+	rPath := fmt.Sprintf("%s/%s", recordsNamespace, idHash)
+	mPath := fmt.Sprintf("%s/%s", metadataNamespace, idHash)
+	if !s.be.Has(rPath) && !s.be.Has(mPath) {
+		return nil
+	}
+	rs, err := s.legacy(idHash)
+	if err != nil {
+		return err
+	}
+	byService := make(map[string][]*eridanus.TagRecord)
+	for _, r := range rs {
+		byService[serviceFor(r)] = append(byService[serviceFor(r)], r)
+	}
+	for name, rs := range byService {
+		v := s.view(name)
+		merged, _, err := v.merge(idHash, rs)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if len(tags) > 0 {
-			idHashes = append(idHashes, idHash)
+		if err := v.store(idHash, merged); err != nil {
+			return err
 		}
 	}
-	return idHashes, nil
+	for _, k := range []string{rPath, mPath} {
+		if s.be.Has(k) {
+			if err := s.be.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateTags moves the tags stored before services to the services for
+// their sources, returning the number of items moved.
+func (s *tagStorage) MigrateTags() (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var n int
+	for _, ns := range []string{recordsNamespace, metadataNamespace} {
+		keys, err := s.be.Keys(ns + "/")
+		if err != nil {
+			return n, err
+		}
+		for _, k := range keys {
+			if err := s.all.migrate(eridanus.IDHash(strings.TrimPrefix(k, ns+"/"))); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Find provides the hashes of tagged items matching the query, treating
+// siblings as equivalent and matching the tags implied by those of items.
+func (s *tagStorage) Find(q *eridanus.TagQuery) (eridanus.IDHashes, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.loadIndex(); err != nil {
+		return nil, err
+	}
+	sib, err := s.siblings()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.parents(); err != nil {
+		return nil, err
+	}
+	if q != nil && q.Expr != nil && (len(sib.GetSiblings()) > 0 || len(s.implying) > 0) {
+		expanded := *q
+		expanded.Expr = s.expand(q.Expr, sib)
+		q = &expanded
+	}
+	return s.ix.find(q, s.info)
+}
+
+// info provides the content info for the hash, nil if there is no content.
+func (s *tagStorage) info(idHash eridanus.IDHash) (*eridanus.ContentInfo, error) {
+	if !s.ds.Has(idHash) {
+		return nil, nil
+	}
+	return s.ds.Info(idHash)
 }
@@ -0,0 +1,96 @@
+package tags
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/scytrin/eridanus"
+	"github.com/scytrin/eridanus/storage/content"
+)
+
+func TestRecords(t *testing.T) {
+	be := newTestBackend(t)
+	if err := be.Set(metadataNamespace+"/aa", strings.NewReader("creator:calm,cat")); err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTagStorage(be, content.NewContentStorage(be))
+
+	if err := ts.Add("aa", &eridanus.TagRecord{
+		Tag: "title:one, two", Source: eridanus.TagRecord_PARSER, Parser: "p", Url: "http://example.com/1",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Put("bb", eridanus.Tags{"x,y"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := be.Set(metadataNamespace+"/cc", strings.NewReader("dog")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		h    eridanus.IDHash
+		want string
+	}{
+		{"aa", `["title:one, two" "creator:calm" "cat"]`},
+		{"bb", `["x,y"]`},
+		{"cc", `["dog"]`},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			got, err := ts.Get(test.h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%q", got.ToSlice()) != test.want {
+				t.Errorf("got %q, want %v", got.ToSlice(), test.want)
+			}
+		})
+	}
+
+	rs, err := ts.Records("aa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprintf("%v %v %v", rs[0].GetSource(), rs[0].GetParser(), rs[0].GetService()), "PARSER p downloader tags"; got != want {
+		t.Errorf("added: got %v, want %v", got, want)
+	}
+	if rs[0].GetAdded() == "" {
+		t.Error("added time not recorded")
+	}
+	if got, want := fmt.Sprintf("%v %v", rs[1].GetSource(), rs[1].GetService()), "UNKNOWN my tags"; got != want {
+		t.Errorf("migrated: got %v, want %v", got, want)
+	}
+	if be.Has(metadataNamespace + "/aa") {
+		t.Error("comma separated tags kept after update")
+	}
+
+	// putting tags keeps the records of those already set
+	if err := ts.Put("aa", eridanus.Tags{"cat", "hat"}); err != nil {
+		t.Fatal(err)
+	}
+	my, err := ts.Service(eridanus.ServiceMyTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs, err = my.Records("aa"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rs[0].GetSource(), rs[1].GetSource()), "UNKNOWN MANUAL"; got != want {
+		t.Errorf("sources: got %v, want %v", got, want)
+	}
+
+	n, err := ts.MigrateTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || be.Has(metadataNamespace+"/cc") || !my.Has("cc") {
+		t.Errorf("MigrateTags: got %d, want 1 item converted", n)
+	}
+	hashes, err := ts.Hashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(hashes), "[aa bb cc]"; got != want {
+		t.Errorf("Hashes: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,666 @@
+package eridanus
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TagItem is an item considered by a TagQuery.
+type TagItem struct {
+	Hash IDHash
+	Tags Tags
+	Info *ContentInfo // nil if unknown
+}
+
+// TagExpr is a condition on a TagItem.
+type TagExpr interface {
+	Match(*TagItem) bool
+	String() string
+}
+
+// TagAnd matches items matching all of its expressions.
+type TagAnd []TagExpr
+
+// Match implements TagExpr.
+func (e TagAnd) Match(item *TagItem) bool {
+	for _, x := range e {
+		if !x.Match(item) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e TagAnd) String() string {
+	strs := make([]string, len(e))
+	for i, x := range e {
+		strs[i] = x.String()
+	}
+	return strings.Join(strs, " ")
+}
+
+// TagOr matches items matching any of its expressions.
+type TagOr []TagExpr
+
+// Match implements TagExpr.
+func (e TagOr) Match(item *TagItem) bool {
+	for _, x := range e {
+		if x.Match(item) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e TagOr) String() string {
+	strs := make([]string, len(e))
+	for i, x := range e {
+		strs[i] = grouped(x)
+	}
+	return "(" + strings.Join(strs, " OR ") + ")"
+}
+
+// TagNot matches items not matching its expression.
+type TagNot struct{ Expr TagExpr }
+
+// Match implements TagExpr.
+func (e TagNot) Match(item *TagItem) bool { return !e.Expr.Match(item) }
+
+func (e TagNot) String() string { return "-" + grouped(e.Expr) }
+
+// grouped returns the expression's string, parenthesized if it has several terms.
+func grouped(e TagExpr) string {
+	if and, ok := e.(TagAnd); ok && len(and) > 1 {
+		return "(" + and.String() + ")"
+	}
+	return e.String()
+}
+
+// TagMatch matches items with a tag equal to the pattern, ignoring case, where
+// * in the pattern matches any run of characters, as in creator:* or cal*.
+type TagMatch string
+
+// Match implements TagExpr.
+func (e TagMatch) Match(item *TagItem) bool {
+	pattern := strings.ToLower(string(e))
+	for _, t := range item.Tags {
+		if MatchTag(pattern, Tag(strings.ToLower(string(t)))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e TagMatch) String() string {
+	if strings.IndexFunc(string(e), func(r rune) bool { return unicode.IsSpace(r) || r == '(' || r == ')' }) >= 0 ||
+		strings.HasPrefix(string(e), "-") || string(e) == "OR" {
+		return `"` + string(e) + `"`
+	}
+	return string(e)
+}
+
+// MatchTag reports whether the lowercased tag matches the lowercased pattern,
+// as by MatchGlob. Tags in reserved namespaces only match patterns naming
+// their namespace.
+func MatchTag(pattern string, t Tag) bool {
+	if !MatchGlob(pattern, string(t)) {
+		return false
+	}
+	if !t.Reserved() {
+		return true
+	}
+	i := strings.IndexByte(pattern, ':')
+	return i >= 0 && pattern[:i] == t.Namespace()
+}
+
+// MatchGlob reports whether s matches the pattern, where * matches any run of
+// characters.
+func MatchGlob(pattern, s string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, pattern[:i]) {
+		return false
+	}
+	s, pattern = s[i:], pattern[i+1:]
+	for {
+		i = strings.IndexByte(pattern, '*')
+		if i < 0 {
+			return strings.HasSuffix(s, pattern)
+		}
+		j := strings.Index(s, pattern[:i])
+		if j < 0 {
+			return false
+		}
+		s, pattern = s[j+i:], pattern[i+1:]
+	}
+}
+
+// The system predicates, written as system:NAME, optionally followed by a
+// comparison operator and value.
+const (
+	SystemSize     = "size"     // content size in bytes, or with a b, kb, mb or gb suffix
+	SystemMIME     = "mime"     // content type, * matching any run of characters
+	SystemImported = "imported" // import time as a date, or age as a duration such as 7d or 12h
+	SystemTags     = "tags"     // number of tags, not counting reserved ones
+	SystemPHash    = "phash"    // has a phash tag, takes no operator
+)
+
+// TagSystem matches items by their content info or tags.
+type TagSystem struct {
+	Name  string
+	Op    string // one of < <= = != >= >
+	Value string
+}
+
+// Match implements TagExpr.
+func (e TagSystem) Match(item *TagItem) bool {
+	switch e.Name {
+	case SystemPHash:
+		for _, t := range item.Tags {
+			if strings.EqualFold(t.Namespace(), NamespacePHash) {
+				return true
+			}
+		}
+		return false
+	case SystemTags:
+		n, err := strconv.Atoi(e.Value)
+		return err == nil && compare(e.Op, userTagCount(item.Tags.OmitDuplicates()), int64(n))
+	}
+	if item.Info == nil {
+		return false
+	}
+	switch e.Name {
+	case SystemSize:
+		n, err := parseSize(e.Value)
+		return err == nil && compare(e.Op, item.Info.Size, n)
+	case SystemMIME:
+		match := MatchGlob(strings.ToLower(e.Value), strings.ToLower(item.Info.MIME))
+		return match == (e.Op == "=")
+	case SystemImported:
+		t, ago, err := parseTime(e.Value, time.Now())
+		if err != nil || item.Info.Imported.IsZero() {
+			return false
+		}
+		if isDate(e.Value) && (e.Op == "=" || e.Op == "!=") { // on the day or not
+			on := !item.Info.Imported.Before(t) && item.Info.Imported.Before(t.AddDate(0, 0, 1))
+			return on == (e.Op == "=")
+		}
+		op := e.Op
+		if ago { // compare ages, so that >7d is more than 7 days ago
+			op = reversedOps[op]
+		}
+		return compare(op, item.Info.Imported.UnixNano(), t.UnixNano())
+	}
+	return false
+}
+
+func (e TagSystem) String() string {
+	return "system:" + e.Name + e.Op + e.Value
+}
+
+func userTagCount(ts Tags) int64 {
+	var n int64
+	for _, t := range ts {
+		if !t.Reserved() {
+			n++
+		}
+	}
+	return n
+}
+
+// reversedOps holds the operator comparing b to a for each comparing a to b.
+var reversedOps = map[string]string{"<": ">", "<=": ">=", "=": "=", "!=": "!=", ">=": "<=", ">": "<"}
+
+func compare(op string, a, b int64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">=":
+		return a >= b
+	case ">":
+		return a > b
+	}
+	return false
+}
+
+func parseSize(s string) (int64, error) {
+	s = strings.ToLower(s)
+	unit := int64(1)
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSuffix(s, u.suffix), u.size
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f * float64(unit)), nil
+}
+
+// parseTime parses a date, or a duration before now in days or as understood
+// by time.ParseDuration, reporting which it was as ago.
+func parseTime(s string, now time.Time) (t time.Time, ago bool, err error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", dateLayout} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, false, nil
+		}
+	}
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return now.Add(-time.Duration(n * float64(24*time.Hour))), true, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%q is neither a date nor a duration", s)
+	}
+	return now.Add(-d), true, nil
+}
+
+// dateLayout is that of a date without a time, standing for the whole day.
+const dateLayout = "2006-01-02"
+
+// isDate reports if s is a date without a time.
+func isDate(s string) bool {
+	_, err := time.ParseInLocation(dateLayout, s, time.Local)
+	return err == nil
+}
+
+// The orders of TagQuery results.
+const (
+	SortHash     = "hash"
+	SortImported = "imported"
+	SortSize     = "size"
+	SortTags     = "tags"
+)
+
+// TagQuery selects items by their tags and content info.
+type TagQuery struct {
+	Expr   TagExpr // nil matches every item
+	Sort   string  // one of the Sort constants, SortHash if empty
+	Desc   bool
+	Offset int
+	Limit  int // unlimited if zero
+}
+
+// NeedsInfo indicates if the query requires the content info of items.
+func (q *TagQuery) NeedsInfo() bool {
+	if q == nil {
+		return false
+	}
+	if q.Sort == SortImported || q.Sort == SortSize {
+		return true
+	}
+	var needs func(TagExpr) bool
+	needs = func(e TagExpr) bool {
+		switch e := e.(type) {
+		case TagAnd:
+			for _, x := range e {
+				if needs(x) {
+					return true
+				}
+			}
+		case TagOr:
+			for _, x := range e {
+				if needs(x) {
+					return true
+				}
+			}
+		case TagNot:
+			return needs(e.Expr)
+		case TagSystem:
+			return e.Name == SystemSize || e.Name == SystemMIME || e.Name == SystemImported
+		}
+		return false
+	}
+	return needs(q.Expr)
+}
+
+// Match indicates if the item matches the query's expression.
+func (q *TagQuery) Match(item *TagItem) bool {
+	return q == nil || q.Expr == nil || q.Expr.Match(item)
+}
+
+// Select sorts and paginates the matching items. Items given in hash order
+// are not sorted again when ordering by hash.
+func (q *TagQuery) Select(items []*TagItem) IDHashes {
+	if q == nil {
+		q = &TagQuery{}
+	}
+	inOrder := (q.Sort == "" || q.Sort == SortHash) &&
+		sort.SliceIsSorted(items, func(i, j int) bool { return items[i].Hash < items[j].Hash })
+
+	var matched []*TagItem
+	for i := range items {
+		item := items[i]
+		if inOrder && q.Desc {
+			item = items[len(items)-1-i]
+		}
+		if !q.Match(item) {
+			continue
+		}
+		matched = append(matched, item)
+		if inOrder && q.Limit > 0 && len(matched) == q.Offset+q.Limit {
+			break
+		}
+	}
+
+	if !inOrder {
+		key := func(item *TagItem) int64 {
+			switch q.Sort {
+			case SortTags:
+				return userTagCount(item.Tags)
+			case SortSize:
+				if item.Info != nil {
+					return item.Info.Size
+				}
+			case SortImported:
+				if item.Info != nil {
+					return item.Info.Imported.UnixNano()
+				}
+			}
+			return 0
+		}
+		sort.SliceStable(matched, func(i, j int) bool {
+			a, b := matched[i], matched[j]
+			if ka, kb := key(a), key(b); ka != kb {
+				return (ka < kb) != q.Desc
+			}
+			return (a.Hash < b.Hash) != q.Desc
+		})
+	}
+
+	if q.Offset >= len(matched) {
+		return nil
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	out := make(IDHashes, len(matched))
+	for i, item := range matched {
+		out[i] = item.Hash
+	}
+	return out
+}
+
+func (q *TagQuery) String() string {
+	var strs []string
+	if q.Expr != nil {
+		strs = append(strs, q.Expr.String())
+	}
+	if (q.Sort != "" && q.Sort != SortHash) || q.Desc {
+		sort := q.Sort
+		if sort == "" {
+			sort = SortHash
+		}
+		if q.Desc {
+			sort = "-" + sort
+		}
+		strs = append(strs, "system:sort="+sort)
+	}
+	if q.Offset > 0 {
+		strs = append(strs, fmt.Sprintf("system:offset=%d", q.Offset))
+	}
+	if q.Limit > 0 {
+		strs = append(strs, fmt.Sprintf("system:limit=%d", q.Limit))
+	}
+	return strings.Join(strs, " ")
+}
+
+// ParseTagQuery parses a query of whitespace separated terms, all of which
+// must match. A term is a tag pattern, quoted if it contains whitespace, or a
+// system predicate. Terms prefixed with - are negated, joined by OR match if
+// either does, and may be grouped with parentheses. The system:sort=ORDER,
+// system:offset=N and system:limit=N terms set the order and page of results,
+// a - before the order reversing it.
+//
+//	creator:calm -rating:explicit (cat OR dog) system:size>1mb system:sort=-imported
+func ParseTagQuery(s string) (*TagQuery, error) {
+	p := &tagQueryParser{q: &TagQuery{}}
+	if err := p.tokenize(s); err != nil {
+		return nil, err
+	}
+	expr, err := p.and(true)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	p.q.Expr = expr
+	return p.q, nil
+}
+
+type tagQueryToken struct {
+	text   string
+	quoted bool
+}
+
+type tagQueryParser struct {
+	q      *TagQuery
+	tokens []tagQueryToken
+	pos    int
+}
+
+func (p *tagQueryParser) tokenize(s string) error {
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		switch r := rs[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			p.tokens = append(p.tokens, tagQueryToken{text: string(r)})
+			i++
+		case r == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]):
+			p.tokens = append(p.tokens, tagQueryToken{text: "-"})
+			i++
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				j++
+			}
+			if j == len(rs) {
+				return fmt.Errorf("unterminated quote at %d", i)
+			}
+			p.tokens = append(p.tokens, tagQueryToken{text: string(rs[i+1 : j]), quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && rs[j] != '(' && rs[j] != ')' {
+				j++
+			}
+			p.tokens = append(p.tokens, tagQueryToken{text: string(rs[i:j])})
+			i = j
+		}
+	}
+	return nil
+}
+
+func (p *tagQueryParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == text
+}
+
+// and parses terms up to a closing parenthesis or the end of the query.
+func (p *tagQueryParser) and(top bool) (TagExpr, error) {
+	var and TagAnd
+	for p.pos < len(p.tokens) && !p.peek(")") {
+		expr, err := p.or(top)
+		if err != nil {
+			return nil, err
+		}
+		if expr != nil {
+			and = append(and, expr)
+		}
+	}
+	switch len(and) {
+	case 0:
+		return nil, nil
+	case 1:
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *tagQueryParser) or(top bool) (TagExpr, error) {
+	expr, err := p.unary(top)
+	if err != nil {
+		return nil, err
+	}
+	or := TagOr{expr}
+	for p.peek("OR") {
+		p.pos++
+		expr, err := p.unary(false)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expr)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	for _, e := range or {
+		if e == nil {
+			return nil, fmt.Errorf("OR of a sort, offset or limit term")
+		}
+	}
+	return or, nil
+}
+
+// unary parses a term, returning nil for a term setting the order or page.
+func (p *tagQueryParser) unary(top bool) (TagExpr, error) {
+	if p.pos == len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of query")
+	}
+	switch {
+	case p.peek("-"):
+		p.pos++
+		expr, err := p.unary(false)
+		if err != nil {
+			return nil, err
+		}
+		if expr == nil {
+			return nil, fmt.Errorf("negated sort, offset or limit term")
+		}
+		return TagNot{expr}, nil
+	case p.peek("("):
+		p.pos++
+		expr, err := p.and(false)
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("unclosed parenthesis")
+		}
+		p.pos++
+		if expr == nil {
+			return nil, fmt.Errorf("empty parentheses")
+		}
+		return expr, nil
+	case p.peek(")"), p.peek("OR"):
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+
+	tok := p.tokens[p.pos]
+	p.pos++
+	if tok.quoted || !strings.HasPrefix(strings.ToLower(tok.text), "system:") {
+		if tok.text == "" {
+			return nil, fmt.Errorf("empty tag")
+		}
+		return TagMatch(tok.text), nil
+	}
+	return p.system(tok.text[len("system:"):], top)
+}
+
+func (p *tagQueryParser) system(s string, top bool) (TagExpr, error) {
+	i := strings.IndexAny(s, "<>=!")
+	if i < 0 {
+		i = len(s)
+	}
+	name, rest := strings.ToLower(s[:i]), s[i:]
+	var op string
+	for _, o := range []string{"<=", ">=", "!=", "<", ">", "="} {
+		if strings.HasPrefix(rest, o) {
+			op = o
+			break
+		}
+	}
+	value := rest[len(op):]
+	if op == "" && rest != "" {
+		return nil, fmt.Errorf("system:%s: bad operator", s)
+	}
+
+	switch name {
+	case "sort", "offset", "limit":
+		if !top {
+			return nil, fmt.Errorf("system:%s must not be negated, joined by OR or grouped", s)
+		}
+		if op != "=" {
+			return nil, fmt.Errorf("system:%s: want =", s)
+		}
+		if name == "sort" {
+			p.q.Desc = strings.HasPrefix(value, "-")
+			switch p.q.Sort = strings.TrimPrefix(value, "-"); p.q.Sort {
+			case SortHash, SortImported, SortSize, SortTags:
+			default:
+				return nil, fmt.Errorf("system:%s: unknown order", s)
+			}
+			return nil, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("system:%s: want a count", s)
+		}
+		if name == "offset" {
+			p.q.Offset = n
+		} else {
+			p.q.Limit = n
+		}
+		return nil, nil
+	case SystemPHash:
+		if op != "" {
+			return nil, fmt.Errorf("system:%s takes no value", name)
+		}
+	case SystemMIME:
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("system:%s: want = or !=", s)
+		}
+	case SystemSize:
+		if _, err := parseSize(value); err != nil {
+			return nil, fmt.Errorf("system:%s: bad size", s)
+		}
+	case SystemImported:
+		if _, _, err := parseTime(value, time.Now()); err != nil {
+			return nil, fmt.Errorf("system:%s: %v", s, err)
+		}
+	case SystemTags:
+		if _, err := strconv.Atoi(value); err != nil {
+			return nil, fmt.Errorf("system:%s: want a count", s)
+		}
+	default:
+		return nil, fmt.Errorf("unknown predicate system:%s", name)
+	}
+	if op == "" && name != SystemPHash {
+		return nil, fmt.Errorf("system:%s: want an operator and value", name)
+	}
+	return TagSystem{Name: name, Op: op, Value: value}, nil
+}